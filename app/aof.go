@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var aofFile *os.File
+var aofLock = sync.Mutex{}
+var aofFsyncPending = false
+
+var aofRewriteInProgress = false
+var aofRewriteScheduled = false
+var aofRewriteBuffer = []byte{}
+var aofBaseSize = int64(0)
+var aofCurrentSize = int64(0)
+
+var errAofRewriteInProgress = fmt.Errorf("background append only file rewriting already in progress")
+
+func validateAppendFsync(value string) error {
+	switch value {
+	case "always", "everysec", "no":
+		return nil
+	}
+
+	return fmt.Errorf("must be one of always, everysec or no")
+}
+
+func validateYesNo(value string) error {
+	if value != "yes" && value != "no" {
+		return fmt.Errorf("must be yes or no")
+	}
+
+	return nil
+}
+
+func aofPath() string {
+	dir := getConfig("dir")
+	if dir == "" {
+		dir = "."
+	}
+
+	return filepath.Join(dir, getConfig("appendfilename"))
+}
+
+func openAppendOnlyFile() error {
+	aofLock.Lock()
+	defer aofLock.Unlock()
+
+	return openAppendOnlyFileLocked()
+}
+
+func openAppendOnlyFileLocked() error {
+	file, err := os.OpenFile(aofPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening append only file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening append only file: %w", err)
+	}
+
+	aofFile = file
+	aofBaseSize = info.Size()
+	aofCurrentSize = info.Size()
+	return nil
+}
+
+func feedAppendOnlyFile(rawCommand string) {
+	aofLock.Lock()
+	defer aofLock.Unlock()
+
+	if aofRewriteInProgress {
+		aofRewriteBuffer = append(aofRewriteBuffer, rawCommand...)
+	}
+
+	if aofFile == nil {
+		return
+	}
+
+	if _, err := aofFile.WriteString(rawCommand); err != nil {
+		fmt.Println("Error writing to append only file:", err.Error())
+		return
+	}
+	aofCurrentSize += int64(len(rawCommand))
+
+	switch getConfig("appendfsync") {
+	case "always":
+		if err := aofFile.Sync(); err != nil {
+			fmt.Println("Error syncing append only file:", err.Error())
+		}
+	case "everysec":
+		aofFsyncPending = true
+	}
+}
+
+func runAofFsyncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		aofLock.Lock()
+		if aofFile != nil && aofFsyncPending {
+			if err := aofFile.Sync(); err != nil {
+				fmt.Println("Error syncing append only file:", err.Error())
+			}
+			aofFsyncPending = false
+		}
+		shouldRewrite := aofFile != nil && !aofRewriteInProgress && (aofRewriteScheduled || aofNeedsRewrite())
+		aofLock.Unlock()
+
+		if shouldRewrite {
+			fmt.Println("Starting automatic rewriting of append only file")
+			if err := startAofRewrite(); err != nil && err != errAofRewriteInProgress {
+				fmt.Println("Error starting automatic append only file rewrite:", err.Error())
+			}
+		}
+	}
+}
+
+func aofNeedsRewrite() bool {
+	percentage, err := strconv.ParseInt(getConfig("auto-aof-rewrite-percentage"), 10, 64)
+	if err != nil || percentage == 0 {
+		return false
+	}
+	minSize, err := parseMemory(getConfig("auto-aof-rewrite-min-size"))
+	if err != nil || aofCurrentSize < minSize {
+		return false
+	}
+
+	base := aofBaseSize
+	if base == 0 {
+		base = 1
+	}
+	growth := (aofCurrentSize - base) * 100 / base
+	return growth >= percentage
+}
+
+// The rewrite snapshots the keyspace as an RDB preamble while writes are held
+// off, then keeps a copy of every command logged after that point so it can be
+// appended to the new file before it replaces the old one.
+func startAofRewrite() error {
+	aofLock.Lock()
+	if aofRewriteInProgress {
+		aofLock.Unlock()
+		return errAofRewriteInProgress
+	}
+	aofRewriteInProgress = true
+	aofRewriteScheduled = false
+	aofLock.Unlock()
+
+	// The snapshot waits on the barrier from its own goroutine, since the
+	// caller may be an EXEC that is still holding it for reading.
+	go func() {
+		writeBarrier.Lock()
+		items := keyspace.Snapshot()
+		aofLock.Lock()
+		aofRewriteBuffer = []byte{}
+		aofLock.Unlock()
+		writeBarrier.Unlock()
+
+		if err := finishAofRewrite(items); err != nil {
+			fmt.Println("Background append only file rewrite failed:", err.Error())
+			return
+		}
+		fmt.Println("Background append only file rewriting terminated with success")
+	}()
+
+	return nil
+}
+
+// After a full resync the file still holds the history from before it, so
+// it's rebuilt from the loaded keyspace. A rewrite that is already running
+// snapshotted the old keyspace, so another one is scheduled to follow it.
+func restartAofAfterSync() {
+	if getConfig("appendonly") != "yes" {
+		return
+	}
+
+	err := startAofRewrite()
+	if err == errAofRewriteInProgress {
+		aofLock.Lock()
+		aofRewriteScheduled = true
+		aofLock.Unlock()
+		return
+	}
+	if err != nil {
+		fmt.Println("Error rewriting append only file after sync:", err.Error())
+	}
+}
+
+func finishAofRewrite(items map[string]CacheItem) error {
+	path := aofPath()
+	tempPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+
+	file, err := os.Create(tempPath)
+	if err == nil {
+		err = encodeRdb(file, items)
+	}
+
+	aofLock.Lock()
+	defer aofLock.Unlock()
+
+	buffer := aofRewriteBuffer
+	aofRewriteInProgress = false
+	aofRewriteBuffer = []byte{}
+
+	if err == nil {
+		_, err = file.Write(buffer)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("error rewriting append only file: %w", err)
+	}
+
+	if aofFile != nil {
+		aofFile.Close()
+		aofFile = nil
+	}
+	if getConfig("appendonly") == "yes" {
+		return openAppendOnlyFileLocked()
+	}
+
+	return nil
+}
+
+func setAppendOnly(value string) error {
+	aofLock.Lock()
+	enabled := aofFile != nil
+	aofLock.Unlock()
+
+	if value == "no" {
+		closeAppendOnlyFile()
+		return nil
+	}
+	if enabled {
+		return nil
+	}
+
+	if err := startAofRewrite(); err != nil && err != errAofRewriteInProgress {
+		return err
+	}
+	return nil
+}
+
+func closeAppendOnlyFile() {
+	aofLock.Lock()
+	defer aofLock.Unlock()
+
+	if aofFile == nil {
+		return
+	}
+
+	if err := aofFile.Sync(); err != nil {
+		fmt.Println("Error syncing append only file:", err.Error())
+	}
+	aofFile.Close()
+	aofFile = nil
+}
+
+// A command cut off by a crash can only be at the end of the file, so
+// everything up to the last complete command (or the start of an unfinished
+// MULTI) is kept and the tail is dropped when aof-load-truncated allows it.
+func loadAppendOnlyFile() error {
+	path := aofPath()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No append only file at %s, starting empty\n", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error loading append only file: %w", err)
+	}
+
+	preambleSize := 0
+	if bytes.HasPrefix(data, []byte("REDIS")) {
+		parsed, err := parseRdb(data)
+		if err != nil {
+			return fmt.Errorf("error loading append only file rdb preamble: %w", err)
+		}
+		applyRdb(parsed)
+		preambleSize = parsed.size
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data[preambleSize:]))
+	client := &Client{
+		queueFlag:    false,
+		commandQueue: [][]string{},
+	}
+	reply := newRespWriter(io.Discard, client)
+
+	offset := preambleSize
+	validOffset := preambleSize
+	numCommands := 0
+	for {
+		rawCommand, commandName, args, err := parseRespCommand(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error loading append only file at offset %d: %w", offset, err)
+		}
+		offset += len(rawCommand)
+
+		if _, exists := commands[commandName]; !exists {
+			return fmt.Errorf("error loading append only file: unknown command '%s' at offset %d", commandName, offset)
+		}
+
+		if client.queueFlag && commandName != "exec" && commandName != "discard" {
+			client.commandQueue = append(client.commandQueue, append([]string{commandName}, args...))
+			continue
+		}
+
+		if err := runCommand(commandName, args, client, reply); err != nil {
+			if _, ok := err.(replyError); !ok {
+				return fmt.Errorf("error loading append only file at offset %d: %w", offset, err)
+			}
+		}
+		client.propagation = nil
+		numCommands++
+
+		if !client.queueFlag {
+			validOffset = offset
+		}
+	}
+
+	if len(data) != validOffset {
+		if err := truncateAppendOnlyFile(path, validOffset); err != nil {
+			return err
+		}
+	}
+
+	dirty.Store(0)
+	fmt.Printf("DB loaded from append only file: %d commands\n", numCommands)
+	return nil
+}
+
+func truncateAppendOnlyFile(path string, validOffset int) error {
+	if getConfig("aof-load-truncated") != "yes" {
+		return fmt.Errorf("append only file is truncated after offset %d, refusing to start (set aof-load-truncated yes to recover)", validOffset)
+	}
+
+	fmt.Printf("Append only file is truncated, dropping everything after offset %d\n", validOffset)
+	if err := os.Truncate(path, int64(validOffset)); err != nil {
+		return fmt.Errorf("error truncating append only file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clusterSlots = 16384
+const clusterGossipInterval = time.Second
+
+const crossSlotErr replyError = "CROSSSLOT Keys in request don't hash to the same slot"
+const clusterDownErr replyError = "CLUSTERDOWN Hash slot not served"
+
+type clusterNode struct {
+	id          string
+	host        string
+	port        string
+	configEpoch int64
+	lastPong    time.Time
+}
+
+// Every node knows the owner of each slot. Ownership spreads by gossip, and
+// a conflicting claim is settled in favour of the node with the higher
+// config epoch, which is how a slot moved with SETSLOT NODE wins over its
+// previous owner.
+type clusterState struct {
+	lock sync.Mutex
+
+	myself       *clusterNode
+	nodes        map[string]*clusterNode
+	slots        [clusterSlots]*clusterNode
+	migrating    map[int]*clusterNode
+	importing    map[int]*clusterNode
+	currentEpoch int64
+}
+
+var cluster *clusterState
+
+func clusterEnabled() bool {
+	return cluster != nil
+}
+
+func initCluster() {
+	myself := &clusterNode{
+		id:   generateReplId(),
+		host: getConfig("cluster-announce-ip"),
+		port: getConfig("port"),
+	}
+
+	cluster = &clusterState{
+		myself:    myself,
+		nodes:     map[string]*clusterNode{myself.id: myself},
+		migrating: map[int]*clusterNode{},
+		importing: map[int]*clusterNode{},
+	}
+
+	fmt.Printf("Cluster mode enabled, node id %s\n", myself.id)
+	go runClusterGossip()
+}
+
+var crc16Table = func() [256]uint16 {
+	table := [256]uint16{}
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC16-CCITT (XModem), as used by Redis Cluster.
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// Only the part between the first { and the following } is hashed, if that
+// part is non-empty, so related keys can be forced into the same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16([]byte(key)) & (clusterSlots - 1))
+}
+
+func firstKey(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[:1]
+}
+
+func xreadKeys(args []string) []string {
+	for i, arg := range args {
+		if strings.ToLower(arg) == "streams" {
+			rest := args[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+func commandKeys(commandName string, args []string, client *Client) []string {
+	if commandName == "exec" {
+		keys := []string{}
+		for _, command := range client.commandQueue {
+			keys = append(keys, commandKeys(command[0], command[1:], client)...)
+		}
+		return keys
+	}
+
+	if command, exists := commands[commandName]; exists && command.getKeys != nil {
+		return command.getKeys(args)
+	}
+	return nil
+}
+
+// Returns the error reply for a command whose keys aren't all served by this
+// node, or "" if it can run here. The master link and the AOF loader (which
+// has no connection) are never redirected.
+func clusterRedirect(commandName string, args []string, client *Client) error {
+	if !clusterEnabled() || client.conn == nil || client.fromMaster {
+		return nil
+	}
+
+	keys := commandKeys(commandName, args, client)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return crossSlotErr
+		}
+	}
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	owner := cluster.slots[slot]
+	if owner == nil {
+		return clusterDownErr
+	}
+
+	if owner != cluster.myself {
+		if importer := cluster.importing[slot]; importer != nil && client.asking {
+			return nil
+		}
+		return replyError(fmt.Sprintf("MOVED %d %s:%s", slot, owner.host, owner.port))
+	}
+
+	// Keys already moved away from a migrating slot are looked up on the
+	// target node, which only serves them after ASKING.
+	if target := cluster.migrating[slot]; target != nil {
+		for _, key := range keys {
+			if _, exists := keyspace.Get(key); !exists {
+				return replyError(fmt.Sprintf("ASK %d %s:%s", slot, target.host, target.port))
+			}
+		}
+	}
+
+	return nil
+}
+
+func formatSlotRanges(ranges [][2]int) string {
+	if len(ranges) == 0 {
+		return "-"
+	}
+
+	parts := []string{}
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			parts = append(parts, strconv.Itoa(r[0]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseSlotRanges(value string) ([]int, error) {
+	slots := []int{}
+	if value == "-" {
+		return slots, nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		startStr, endStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			endStr = startStr
+		}
+		start, err := strconv.Atoi(startStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot range %q", part)
+		}
+		end, err := strconv.Atoi(endStr)
+		if err != nil || start < 0 || end >= clusterSlots || start > end {
+			return nil, fmt.Errorf("invalid slot range %q", part)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+
+	return slots, nil
+}
+
+// Must be called with cluster.lock held.
+func nodeSlotRanges(node *clusterNode) [][2]int {
+	ranges := [][2]int{}
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cluster.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// Must be called with cluster.lock held.
+func sortedClusterNodes() []*clusterNode {
+	nodes := []*clusterNode{}
+	for _, node := range cluster.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// Must be called with cluster.lock held.
+func applySlotClaims(node *clusterNode, configEpoch int64, claimed []int) {
+	node.configEpoch = configEpoch
+	cluster.currentEpoch = max(cluster.currentEpoch, configEpoch)
+
+	claims := map[int]bool{}
+	for _, slot := range claimed {
+		claims[slot] = true
+		owner := cluster.slots[slot]
+		if owner == nil || owner == node || node.configEpoch > owner.configEpoch {
+			cluster.slots[slot] = node
+			if cluster.importing[slot] == node || cluster.migrating[slot] == node {
+				delete(cluster.importing, slot)
+				delete(cluster.migrating, slot)
+			}
+		}
+	}
+
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cluster.slots[slot] == node && !claims[slot] {
+			cluster.slots[slot] = nil
+		}
+	}
+}
+
+func clusterGossipMessage() []string {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	myself := cluster.myself
+	return []string{
+		"CLUSTER", "PING", myself.id, myself.port,
+		strconv.FormatInt(myself.configEpoch, 10), formatSlotRanges(nodeSlotRanges(myself)),
+	}
+}
+
+// A ping tells the other node who we are and which slots we own. Its reply
+// does the same for that node, followed by the other nodes it knows about,
+// which is how a MEET with one node joins us to the whole cluster.
+func pingClusterNode(address string) (*clusterNode, error) {
+	reply, err := sendRequest(address, clusterGossipMessage()...)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return nil, fmt.Errorf("empty gossip reply")
+	}
+
+	fields := strings.Fields(reply[0])
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid gossip reply %q", reply[0])
+	}
+	configEpoch, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gossip reply %q", reply[0])
+	}
+	claimed, err := parseSlotRanges(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(address)
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	node := learnClusterNode(fields[0], host, fields[2])
+	node.lastPong = time.Now()
+	applySlotClaims(node, configEpoch, claimed)
+
+	for _, other := range reply[1:] {
+		if parts := strings.Fields(other); len(parts) == 3 {
+			learnClusterNode(parts[0], parts[1], parts[2])
+		}
+	}
+
+	return node, nil
+}
+
+// Must be called with cluster.lock held.
+func learnClusterNode(id string, host string, port string) *clusterNode {
+	node, exists := cluster.nodes[id]
+	if !exists {
+		fmt.Printf("Learned about cluster node %s at %s:%s\n", id, host, port)
+		node = &clusterNode{id: id}
+		cluster.nodes[id] = node
+	}
+	if node != cluster.myself {
+		node.host = host
+		node.port = port
+	}
+	return node
+}
+
+func runClusterGossip() {
+	ticker := time.NewTicker(clusterGossipInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cluster.lock.Lock()
+		addresses := []string{}
+		for _, node := range cluster.nodes {
+			if node != cluster.myself {
+				addresses = append(addresses, net.JoinHostPort(node.host, node.port))
+			}
+		}
+		cluster.lock.Unlock()
+
+		for _, address := range addresses {
+			if _, err := pingClusterNode(address); err != nil {
+				fmt.Printf("Error pinging cluster node %s: %s\n", address, err.Error())
+			}
+		}
+	}
+}
+
+func askingCommand(args []string, client *Client, reply Reply) error {
+	if !clusterEnabled() {
+		return replyError("ERR This instance has cluster support disabled")
+	}
+
+	client.asking = true
+	reply.Status("OK")
+	return nil
+}
+
+func clusterCommand(args []string, client *Client, reply Reply) error {
+	if len(args) == 0 {
+		return wrongArgsErr("cluster")
+	}
+	if !clusterEnabled() {
+		return replyError("ERR This instance has cluster support disabled")
+	}
+
+	subcommand := strings.ToLower(args[0])
+	switch subcommand {
+	case "keyslot":
+		if len(args) != 2 {
+			return wrongArgsErr("cluster|keyslot")
+		}
+		reply.Int(int64(keyHashSlot(args[1])))
+		return nil
+	case "meet":
+		if len(args) != 3 {
+			return wrongArgsErr("cluster|meet")
+		}
+		if _, err := pingClusterNode(net.JoinHostPort(args[1], args[2])); err != nil {
+			return replyError(fmt.Sprintf("ERR Can't meet %s:%s: %s", args[1], args[2], err.Error()))
+		}
+		reply.Status("OK")
+		return nil
+	case "ping":
+		return clusterPing(args[1:], client, reply)
+	}
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	switch subcommand {
+	case "myid":
+		reply.Bulk(cluster.myself.id)
+		return nil
+	case "addslots", "delslots":
+		if len(args) < 2 {
+			return wrongArgsErr("cluster|" + subcommand)
+		}
+		slots := []int{}
+		for _, arg := range args[1:] {
+			slot, err := strconv.Atoi(arg)
+			if err != nil || slot < 0 || slot >= clusterSlots {
+				return replyError("ERR Invalid or out of range slot")
+			}
+			owner := cluster.slots[slot]
+			if subcommand == "addslots" && owner != nil {
+				return replyError(fmt.Sprintf("ERR Slot %d is already busy", slot))
+			}
+			if subcommand == "delslots" && owner == nil {
+				return replyError(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+			}
+			slots = append(slots, slot)
+		}
+		for _, slot := range slots {
+			if subcommand == "addslots" {
+				cluster.slots[slot] = cluster.myself
+			} else {
+				cluster.slots[slot] = nil
+			}
+		}
+		reply.Status("OK")
+		return nil
+	case "setslot":
+		if err := clusterSetSlot(args[1:]); err != nil {
+			return err
+		}
+		reply.Status("OK")
+		return nil
+	case "info":
+		reply.Verbatim("txt", clusterInfo())
+		return nil
+	case "nodes":
+		reply.Verbatim("txt", clusterNodes())
+		return nil
+	case "slots":
+		replyWithClusterSlots(reply)
+		return nil
+	case "shards":
+		replyWithClusterShards(reply)
+		return nil
+	}
+
+	return replyError(fmt.Sprintf("ERR Unknown subcommand or wrong number of arguments for '%s'", args[0]))
+}
+
+func clusterPing(args []string, client *Client, reply Reply) error {
+	if len(args) != 4 {
+		return wrongArgsErr("cluster|ping")
+	}
+	configEpoch, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return notIntegerErr
+	}
+	claimed, err := parseSlotRanges(args[3])
+	if err != nil {
+		return replyError("ERR Invalid or out of range slot")
+	}
+
+	host, _, err := net.SplitHostPort(client.conn.RemoteAddr().String())
+	if err != nil {
+		return fmt.Errorf("error performing cluster ping: %w", err)
+	}
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+
+	sender := learnClusterNode(args[0], host, args[1])
+	sender.lastPong = time.Now()
+	applySlotClaims(sender, configEpoch, claimed)
+
+	myself := cluster.myself
+	known := []string{fmt.Sprintf("%s %s %s %d %s",
+		myself.id, myself.host, myself.port, myself.configEpoch, formatSlotRanges(nodeSlotRanges(myself)))}
+	for _, node := range sortedClusterNodes() {
+		if node != myself && node != sender {
+			known = append(known, fmt.Sprintf("%s %s %s", node.id, node.host, node.port))
+		}
+	}
+
+	reply.Array(len(known))
+	for _, line := range known {
+		reply.Bulk(line)
+	}
+	return nil
+}
+
+// Must be called with cluster.lock held.
+func clusterSetSlot(args []string) error {
+	if len(args) < 2 {
+		return wrongArgsErr("cluster|setslot")
+	}
+	slot, err := strconv.Atoi(args[0])
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return replyError("ERR Invalid or out of range slot")
+	}
+
+	action := strings.ToLower(args[1])
+	if action == "stable" {
+		delete(cluster.migrating, slot)
+		delete(cluster.importing, slot)
+		return nil
+	}
+
+	if len(args) != 3 {
+		return wrongArgsErr("cluster|setslot")
+	}
+	node, exists := cluster.nodes[args[2]]
+	if !exists {
+		return replyError(fmt.Sprintf("ERR I don't know about node %s", args[2]))
+	}
+
+	switch action {
+	case "migrating":
+		if cluster.slots[slot] != cluster.myself {
+			return replyError(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		cluster.migrating[slot] = node
+	case "importing":
+		if cluster.slots[slot] == cluster.myself {
+			return replyError(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		cluster.importing[slot] = node
+	case "node":
+		// Taking over a slot needs a config epoch greater than any other so
+		// our claim beats the previous owner's when it spreads by gossip.
+		if node == cluster.myself && cluster.slots[slot] != cluster.myself {
+			cluster.currentEpoch++
+			cluster.myself.configEpoch = cluster.currentEpoch
+		}
+		cluster.slots[slot] = node
+		delete(cluster.migrating, slot)
+		delete(cluster.importing, slot)
+	default:
+		return replyError("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+
+	return nil
+}
+
+// Must be called with cluster.lock held.
+func clusterInfo() string {
+	assigned := 0
+	owners := map[*clusterNode]bool{}
+	for _, owner := range cluster.slots {
+		if owner != nil {
+			assigned++
+			owners[owner] = true
+		}
+	}
+
+	state := "fail"
+	if assigned == clusterSlots {
+		state = "ok"
+	}
+
+	response := "cluster_enabled:1"
+	addToInfoResponse("cluster_state", state, &response)
+	addToInfoResponse("cluster_slots_assigned", strconv.Itoa(assigned), &response)
+	addToInfoResponse("cluster_slots_ok", strconv.Itoa(assigned), &response)
+	addToInfoResponse("cluster_slots_pfail", "0", &response)
+	addToInfoResponse("cluster_slots_fail", "0", &response)
+	addToInfoResponse("cluster_known_nodes", strconv.Itoa(len(cluster.nodes)), &response)
+	addToInfoResponse("cluster_size", strconv.Itoa(len(owners)), &response)
+	addToInfoResponse("cluster_current_epoch", strconv.FormatInt(cluster.currentEpoch, 10), &response)
+	addToInfoResponse("cluster_my_epoch", strconv.FormatInt(cluster.myself.configEpoch, 10), &response)
+
+	return response + "\r\n"
+}
+
+// Must be called with cluster.lock held.
+func clusterNodes() string {
+	lines := []string{}
+	for _, node := range sortedClusterNodes() {
+		flags := "master"
+		linkState := "connected"
+		pongTime := node.lastPong.UnixMilli()
+		if node == cluster.myself {
+			flags = "myself,master"
+			pongTime = 0
+		} else if time.Since(node.lastPong) > 3*clusterGossipInterval {
+			linkState = "disconnected"
+		}
+
+		line := fmt.Sprintf("%s %s:%s@%s %s - 0 %d %d %s",
+			node.id, node.host, node.port, node.port, flags, pongTime, node.configEpoch, linkState)
+		for _, r := range nodeSlotRanges(node) {
+			line += " " + formatSlotRanges([][2]int{r})
+		}
+		if node == cluster.myself {
+			for slot, target := range cluster.migrating {
+				line += fmt.Sprintf(" [%d->-%s]", slot, target.id)
+			}
+			for slot, source := range cluster.importing {
+				line += fmt.Sprintf(" [%d-<-%s]", slot, source.id)
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Must be called with cluster.lock held.
+func replyWithClusterSlots(reply Reply) {
+	nodes := sortedClusterNodes()
+	numRanges := 0
+	for _, node := range nodes {
+		numRanges += len(nodeSlotRanges(node))
+	}
+
+	reply.Array(numRanges)
+	for _, node := range nodes {
+		port, _ := strconv.Atoi(node.port)
+		for _, r := range nodeSlotRanges(node) {
+			reply.Array(3)
+			reply.Int(int64(r[0]))
+			reply.Int(int64(r[1]))
+			reply.Array(3)
+			reply.Bulk(node.host)
+			reply.Int(int64(port))
+			reply.Bulk(node.id)
+		}
+	}
+}
+
+// Must be called with cluster.lock held.
+func replyWithClusterShards(reply Reply) {
+	nodes := sortedClusterNodes()
+	reply.Array(len(nodes))
+	for _, node := range nodes {
+		ranges := nodeSlotRanges(node)
+		port, _ := strconv.Atoi(node.port)
+		health := "online"
+		if node != cluster.myself && time.Since(node.lastPong) > 3*clusterGossipInterval {
+			health = "fail"
+		}
+
+		reply.Map(2)
+		reply.Bulk("slots")
+		reply.Array(len(ranges) * 2)
+		for _, r := range ranges {
+			reply.Int(int64(r[0]))
+			reply.Int(int64(r[1]))
+		}
+		reply.Bulk("nodes")
+		reply.Array(1)
+		reply.Map(6)
+		reply.Bulk("id")
+		reply.Bulk(node.id)
+		reply.Bulk("port")
+		reply.Int(int64(port))
+		reply.Bulk("ip")
+		reply.Bulk(node.host)
+		reply.Bulk("endpoint")
+		reply.Bulk(node.host)
+		reply.Bulk("role")
+		reply.Bulk("master")
+		reply.Bulk("health")
+		reply.Bulk(health)
+	}
+}
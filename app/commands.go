@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -9,386 +8,568 @@ import (
 	"time"
 )
 
-const emptyRdb = "524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2"
-
-const xaddEntryIdOlderThanLastErr = "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"
-const xaddEntryIdZeroErr = "-ERR The ID specified in XADD must be greater than 0-0\r\n"
-const incrNotNumErr = "-ERR value is not an integer or out of range\r\n"
-const execNotInQueueModeErr = "-ERR EXEC without MULTI\r\n"
-const discardNotInQueueModeErr = "-ERR DISCARD without MULTI\r\n"
+const xaddEntryIdOlderThanLastErr replyError = "ERR The ID specified in XADD is equal or smaller than the target stream top item"
+const xaddEntryIdZeroErr replyError = "ERR The ID specified in XADD must be greater than 0-0"
+const notIntegerErr replyError = "ERR value is not an integer or out of range"
+const invalidStreamIdErr replyError = "ERR Invalid stream ID specified as stream command argument"
+const execNotInQueueModeErr replyError = "ERR EXEC without MULTI"
+const discardNotInQueueModeErr replyError = "ERR DISCARD without MULTI"
+const bgsaveInProgressErr replyError = "ERR Background save already in progress"
+const aofRewriteInProgressErr replyError = "ERR Background append only file rewriting already in progress"
+const syntaxErr replyError = "ERR syntax error"
+const setInvalidExpireErr replyError = "ERR invalid expire time in 'set' command"
+const noReplicasErr replyError = "NOREPLICAS Not enough good replicas to write."
+const readOnlyReplicaErr replyError = "READONLY You can't write against a read only replica."
+const noMasterLinkErr replyError = "NOMASTERLINK Can't SYNC while not connected with my master"
+const noProtoErr replyError = "NOPROTO unsupported protocol version"
+const wrongPassErr replyError = "WRONGPASS invalid username-password pair or user is disabled."
+const noMultiErr replyError = "ERR Command not allowed inside a transaction"
+const wrongTypeErr replyError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+const waitOnReplicaErr replyError = "ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated."
+
+func wrongArgsErr(commandName string) error {
+	return replyError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", commandName))
+}
 
 var xreadBlockMutex = sync.Mutex{}
 var xreadBlockSignal = sync.NewCond(&xreadBlockMutex)
 
-var commands map[string]func([]string, *Client) (string, error)
+type Command struct {
+	handler func([]string, *Client, Reply) error
+	isWrite bool
+	getKeys func([]string) []string
+
+	// Commands that can't be queued by MULTI. PSYNC in particular takes the
+	// write barrier exclusively, which EXEC may already hold.
+	noMulti bool
+}
 
-func echoCommand(args []string, client *Client) (string, error) {
+var commands map[string]Command
+
+func echoCommand(args []string, client *Client, reply Reply) error {
 	if len(args) == 0 {
-		return "", fmt.Errorf("error performing echo: no args")
+		return wrongArgsErr("echo")
 	}
 
-	return toRespStr(args[0]), nil
+	reply.Bulk(args[0])
+	return nil
 }
 
-func pingCommand(args []string, client *Client) (string, error) {
-	return "+PONG\r\n", nil
+func pingCommand(args []string, client *Client, reply Reply) error {
+	reply.Status("PONG")
+	return nil
 }
 
-func setCommand(args []string, client *Client) (string, error) {
-	now := time.Now()
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(args []string, client *Client, reply Reply) error {
+	protocol := client.protocol
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return replyError("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return noProtoErr
+		}
+		protocol = version
+	}
+
+	name := client.name
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				return replyError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+			}
+			// No passwords can be configured, so only the default user exists
+			// and it accepts any password.
+			if args[i+1] != "default" {
+				return wrongPassErr
+			}
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return replyError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+			}
+			if strings.ContainsFunc(args[i+1], func(r rune) bool { return r <= ' ' || r > '~' }) {
+				return replyError("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = args[i+1]
+			i++
+		default:
+			return replyError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+		}
+	}
 
-	setHasOccurred = true
+	client.protocol = protocol
+	client.name = name
+
+	mode := "standalone"
+	role := "master"
+	if cluster != nil {
+		mode = "cluster"
+	}
+	if sentinel != nil {
+		mode = "sentinel"
+		role = "sentinel"
+	} else if getConfig("role") == "slave" {
+		role = "replica"
+	}
+
+	reply.Map(7)
+	reply.Bulk("server")
+	reply.Bulk("redis")
+	reply.Bulk("version")
+	reply.Bulk("7.2.0")
+	reply.Bulk("proto")
+	reply.Int(int64(reply.Protocol()))
+	reply.Bulk("id")
+	reply.Int(client.id)
+	reply.Bulk("mode")
+	reply.Bulk(mode)
+	reply.Bulk("role")
+	reply.Bulk(role)
+	reply.Bulk("modules")
+	reply.Array(0)
+	return nil
+}
 
-	ackLock.Lock()
-	numAcksSinceLasSet = 0
-	ackLock.Unlock()
+func setCommand(args []string, client *Client, reply Reply) error {
+	now := time.Now()
 
 	if len(args) < 2 {
-		return "", fmt.Errorf("error performing set: not enough args")
+		return wrongArgsErr("set")
 	}
 
 	expiresAt := int64(-1)
-	for i, arg := range args {
-		switch strings.ToLower(arg) {
-		case "px":
-			if i+1 < len(args) {
-				ttl, err := strconv.Atoi(args[i+1])
-				if err != nil {
-					ttl = 0
-				}
-				expiresAt = now.UnixMilli() + int64(ttl)
+	for i := 2; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch option {
+		case "px", "ex", "pxat", "exat":
+			if i+1 >= len(args) {
+				return syntaxErr
+			}
+			amount, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || amount <= 0 {
+				return setInvalidExpireErr
+			}
+			i++
+
+			switch option {
+			case "px":
+				expiresAt = now.UnixMilli() + amount
+			case "ex":
+				expiresAt = now.UnixMilli() + amount*1000
+			case "pxat":
+				expiresAt = amount
+			case "exat":
+				expiresAt = amount * 1000
 			}
 		}
 	}
 
-	keyValueCache[args[0]] = CacheItem{
+	keyspace.Set(args[0], CacheItem{
 		value:     args[1],
 		expiresAt: expiresAt,
 		itemType:  "string",
-	}
-	return "+OK\r\n", nil
-}
+	})
+	markDirty(1)
 
-func getCommand(args []string, client *Client) (string, error) {
-	now := time.Now().UnixMilli()
-
-	if len(args) == 0 {
-		return "", fmt.Errorf("error performing get: no args")
+	if expiresAt != -1 {
+		client.rewrittenCommand = []string{"SET", args[0], args[1], "PXAT", strconv.FormatInt(expiresAt, 10)}
 	}
 
-	var value string
-	var expiresAt int64
-	entry, exists := keyValueCache[args[0]]
-	if exists {
-		value = entry.value
-		expiresAt = entry.expiresAt
-	} else {
-		keysMap, err := getKeys()
-		if err != nil {
-			fmt.Println(err.Error())
-		}
+	reply.Status("OK")
+	return nil
+}
 
-		valueInfo, exists := keysMap[args[0]]
-		if exists {
-			expiresAt = valueInfo.expiresAt
-			value, err = getValue(valueInfo)
-			if err != nil {
-				return "", fmt.Errorf("error performing get: %w", err)
-			}
-		}
+func getCommand(args []string, client *Client, reply Reply) error {
+	if len(args) == 0 {
+		return wrongArgsErr("get")
 	}
 
-	if value == "" {
-		return nullRespStr, nil
+	entry, exists := keyspace.Get(args[0])
+	if !exists {
+		reply.Null()
+		return nil
 	}
-
-	writeVal := toRespStr(value)
-	if expiresAt != -1 && now >= expiresAt {
-		fmt.Println("Entry expired: ", now, entry.expiresAt)
-		writeVal = nullRespStr
+	if entry.itemType != "string" {
+		return wrongTypeErr
 	}
 
-	return writeVal, nil
+	reply.Bulk(entry.value)
+	return nil
 }
 
-func configCommand(args []string, client *Client) (string, error) {
+func configCommand(args []string, client *Client, reply Reply) error {
 	if len(args) == 0 {
-		return "", fmt.Errorf("error performing config: no args")
+		return wrongArgsErr("config")
 	}
 
-	if len(args) < 2 {
-		return "", fmt.Errorf("error performing config get: not enough args")
-	}
+	switch strings.ToLower(args[0]) {
+	case "get":
+		if len(args) < 2 {
+			return wrongArgsErr("config|get")
+		}
 
-	response := nullRespStr
-	value, exists := configParams[args[1]]
-	if exists && value != "" {
-		response = fmt.Sprintf("*2\r\n%s%s", toRespStr(args[1]), toRespStr(value))
-	}
+		value, exists := lookupConfig(args[1])
+		if !exists || value == "" {
+			reply.Null()
+			return nil
+		}
 
-	return response, nil
-}
+		reply.Map(1)
+		reply.Bulk(args[1])
+		reply.Bulk(value)
+		return nil
+	case "set":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return wrongArgsErr("config|set")
+		}
 
-func keysCommand(args []string, client *Client) (string, error) {
-	keysMap, err := getKeys()
-	if err != nil {
-		return "", err
-	}
+		for i := 1; i < len(args); i += 2 {
+			validate, exists := configSetValidators[strings.ToLower(args[i])]
+			if !exists {
+				return replyError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))
+			}
+			if err := validate(args[i+1]); err != nil {
+				return replyError(fmt.Sprintf("ERR Invalid argument '%s' for CONFIG SET '%s' - %s", args[i+1], args[i], err.Error()))
+			}
+		}
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i])
+			setConfig(name, args[i+1])
+			if hook, exists := configSetHooks[name]; exists {
+				if err := hook(args[i+1]); err != nil {
+					return replyError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", args[i], err.Error()))
+				}
+			}
+		}
 
-	response := fmt.Sprintf("*%d\r\n", len(keysMap))
-	for key := range keysMap {
-		response += toRespStr(key)
+		reply.Status("OK")
+		return nil
 	}
 
-	return response, nil
+	return replyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0]))
 }
 
-func infoCommand(args []string, client *Client) (string, error) {
-	if len(args) == 0 {
-		return "", fmt.Errorf("error performing info: no args")
+func keysCommand(args []string, client *Client, reply Reply) error {
+	keys := keyspace.Keys()
+
+	reply.Array(len(keys))
+	for _, key := range keys {
+		reply.Bulk(key)
 	}
 
-	response := "role:" + configParams["role"]
-	if configParams["role"] == "master" {
-		addToInfoResponse("master_replid", configParams["replId"], &response)
-		addToInfoResponse("master_repl_offset", configParams["replOffset"], &response)
+	return nil
+}
+
+func infoCommand(args []string, client *Client, reply Reply) error {
+	response := "role:" + getConfig("role")
+	if getConfig("role") == "master" {
+		addReplicasInfo(&response)
+		addToInfoResponse("master_replid", getConfig("replId"), &response)
+		replicasLock.Lock()
+		addToInfoResponse("master_replid2", getConfig("replId2"), &response)
+		addToInfoResponse("master_repl_offset", strconv.FormatInt(masterReplOffset, 10), &response)
+		addToInfoResponse("second_repl_offset", strconv.FormatInt(secondReplOffset, 10), &response)
+		addToInfoResponse("repl_backlog_active", "1", &response)
+		addToInfoResponse("repl_backlog_size", strconv.Itoa(len(backlog.buffer)), &response)
+		addToInfoResponse("repl_backlog_first_byte_offset", strconv.FormatInt(backlog.firstByteOffset()+1, 10), &response)
+		addToInfoResponse("repl_backlog_histlen", strconv.FormatInt(backlog.histlen, 10), &response)
+		replicasLock.Unlock()
+	} else {
+		addMasterLinkInfo(&response)
+		addReplicasInfo(&response)
 	}
 
-	return toRespStr(response), nil
+	replyWithInfo(reply, response)
+	return nil
 }
 
-func replconfCommand(args []string, client *Client) (string, error) {
+func replconfCommand(args []string, client *Client, reply Reply) error {
 	if len(args) == 0 {
-		return "", fmt.Errorf("error performing replconf: no args")
+		return wrongArgsErr("replconf")
 	}
 
 	switch strings.ToLower(args[0]) {
 	case "listening-port":
-		return "+OK\r\n", nil
+		if len(args) < 2 {
+			return wrongArgsErr("replconf")
+		}
+		client.listeningPort = args[1]
+		reply.Status("OK")
+		return nil
 	case "capa":
-		return "+OK\r\n", nil
+		for i := 0; i+1 < len(args); i += 2 {
+			if strings.ToLower(args[i]) == "capa" && strings.ToLower(args[i+1]) == "eof" {
+				client.capaEof = true
+			}
+		}
+		reply.Status("OK")
+		return nil
 	case "getack":
-		return toRespArr("REPLCONF", "ACK", strconv.Itoa(bytesProcessed)), nil
+		reply.Array(3)
+		reply.Bulk("REPLCONF")
+		reply.Bulk("ACK")
+		reply.Bulk(strconv.FormatInt(bytesProcessed.Load(), 10))
+		return nil
 	case "ack":
 		if len(args) < 2 {
-			return "", fmt.Errorf("error handling replconf ack: not enough args")
+			return wrongArgsErr("replconf")
 		}
 
-		ackLock.Lock()
-		numAcksSinceLasSet++
-		ackLock.Unlock()
-		return "", nil
+		offset, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return notIntegerErr
+		}
+		if client.replica != nil {
+			acknowledgeReplicaOffset(client.replica, offset)
+		}
+		return nil
 	}
 
-	return "", fmt.Errorf("unsupported replconf")
+	return replyError(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", args[0]))
 }
 
-func psyncCommand(args []string, client *Client) (string, error) {
+func psyncCommand(args []string, client *Client, reply Reply) error {
 	if len(args) < 2 {
-		return "", fmt.Errorf("error performing psync: not enough args")
+		return wrongArgsErr("psync")
+	}
+
+	if getConfig("role") == "slave" && !masterLinkIsUp() {
+		return noMasterLinkErr
+	}
+
+	// From here on the replication stream is written straight to the
+	// connection, so earlier replies have to go out first.
+	if err := reply.Flush(); err != nil {
+		return fmt.Errorf("error performing psync: %w", err)
 	}
 
-	if args[0] == "?" {
-		response := fmt.Sprintf("+FULLRESYNC %s 0\r\n", configParams["replId"])
-		if _, err := client.conn.Write([]byte(response)); err != nil {
-			return "", fmt.Errorf("error performing psync: %w", err)
+	if args[0] != "?" {
+		psyncOffset, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return notIntegerErr
 		}
 
-		emptyRdbAsBytes, _ := hex.DecodeString(emptyRdb)
-		fileResponse := append([]byte(fmt.Sprintf("$%d\r\n", len(emptyRdbAsBytes))), emptyRdbAsBytes...)
-		if _, err := client.conn.Write(fileResponse); err != nil {
-			return "", fmt.Errorf("error performing psync: %w", err)
+		if replica := tryPartialResync(client, args[0], psyncOffset); replica != nil {
+			client.replica = replica
+			fmt.Printf("Partial resync accepted from offset %d\n", psyncOffset)
+			return nil
 		}
+	}
 
-		replicasLock.Lock()
-		defer replicasLock.Unlock()
+	// Holding off writes until the replica is registered means nothing
+	// lands between the snapshot and the start of the forwarded stream. The
+	// stream is held back for the replica while the snapshot is transferred.
+	writeBarrier.Lock()
+	replicasLock.Lock()
+	items := keyspace.Snapshot()
+	offset := masterReplOffset
+	client.replica = newReplica(client)
+	client.replica.state = "send_bulk"
+	replicas = append(replicas, client.replica)
+	replicasLock.Unlock()
+	writeBarrier.Unlock()
+
+	reply.Status(fmt.Sprintf("FULLRESYNC %s %d", getConfig("replId"), offset))
+	if err := reply.Flush(); err != nil {
+		return fmt.Errorf("error performing psync: %w", err)
+	}
 
-		replicas = append(replicas, client.conn)
+	if err := sendSnapshot(client, items); err != nil {
+		removeReplica(client.replica)
+		return fmt.Errorf("error performing psync: %w", err)
 	}
+	markReplicaOnline(client.replica)
 
-	return "", nil
+	return nil
 }
 
-func waitCommand(args []string, client *Client) (string, error) {
+func waitCommand(args []string, client *Client, reply Reply) error {
 	if len(args) < 2 {
-		return "", fmt.Errorf("error performing wait: not enough args")
+		return wrongArgsErr("wait")
 	}
-
-	if !setHasOccurred {
-		fmt.Println("Set has not occurred, sending 0")
-		replicasLock.Lock()
-		defer replicasLock.Unlock()
-
-		numAcks := len(replicas)
-
-		response := fmt.Sprintf(":%d\r\n", numAcks)
-		return response, nil
+	// A replica relays its master's stream byte for byte, so a GETACK of its
+	// own would shift its sub-replicas' offsets away from the master's.
+	if getConfig("role") == "slave" {
+		return waitOnReplicaErr
 	}
 
-	replicasLock.Lock()
-	for _, replica := range replicas {
-		if _, err := replica.Write([]byte(toRespArr("REPLCONF", "GETACK", "*"))); err != nil {
-			fmt.Println("Failed to getack after relaying command to replica", err.Error())
-		}
-	}
-	replicasLock.Unlock()
-
 	requiredAcks, err := strconv.Atoi(args[0])
 	if err != nil {
-		return "", fmt.Errorf("error performing wait: %w", err)
+		return notIntegerErr
 	}
 	timeoutMS, err := strconv.Atoi(args[1])
-	if err != nil {
-		return "", fmt.Errorf("error performing wait: %w", err)
+	if err != nil || timeoutMS < 0 {
+		return replyError("ERR timeout is negative or not an integer")
 	}
 
-	timeout := time.Duration(timeoutMS) * time.Millisecond
+	numAcks, _ := countReplicasAcked(client.lastWriteOffset)
+	if numAcks >= requiredAcks || client.inExec {
+		reply.Int(int64(numAcks))
+		return nil
+	}
+
+	forwardCommandToReplicas(toRespArr("REPLCONF", "GETACK", "*"))
+
+	// Earlier pipelined replies go out now rather than after the ACKs.
+	if err := reply.Flush(); err != nil {
+		return fmt.Errorf("error performing wait: %w", err)
+	}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	// A timeout of 0 blocks until enough replicas have caught up.
+	var timeoutChannel <-chan time.Time
+	if timeoutMS > 0 {
+		timeoutChannel = time.After(time.Duration(timeoutMS) * time.Millisecond)
+	}
 
-	timeoutChannel := time.After(timeout)
 	for {
+		numAcks, acked := countReplicasAcked(client.lastWriteOffset)
+		if numAcks >= requiredAcks {
+			reply.Int(int64(numAcks))
+			return nil
+		}
+
 		select {
-		case <-ticker.C:
-			if numAcksSinceLasSet >= requiredAcks {
-				response := fmt.Sprintf(":%d\r\n", numAcksSinceLasSet)
-				return response, nil
-			}
+		case <-acked:
 		case <-timeoutChannel:
-			response := fmt.Sprintf(":%d\r\n", numAcksSinceLasSet)
-			return response, nil
+			numAcks, _ := countReplicasAcked(client.lastWriteOffset)
+			reply.Int(int64(numAcks))
+			return nil
 		}
 	}
 }
 
-func typeCommand(args []string, client *Client) (string, error) {
+func typeCommand(args []string, client *Client, reply Reply) error {
 	if len(args) == 0 {
-		return "", fmt.Errorf("error performing type command: no args")
+		return wrongArgsErr("type")
 	}
 
-	entry, exists := keyValueCache[args[0]]
-	itemType := entry.itemType
+	entry, exists := keyspace.Get(args[0])
 	if !exists {
-		_, exists := streamCache[args[0]]
-		if exists {
-			itemType = "stream"
-		} else if len(rdbFile) != 0 {
-			keys, err := getKeys()
-			if err != nil {
-				return "", fmt.Errorf("error performing type command: %w", err)
-			}
-			_, exists = keys[args[0]]
-			if exists {
-				itemType = "string"
-			}
-		}
+		reply.Status("none")
+		return nil
 	}
 
-	if itemType != "" {
-		return fmt.Sprintf("+%s\r\n", itemType), nil
-	} else {
-		return "+none\r\n", nil
-	}
+	reply.Status(entry.itemType)
+	return nil
 }
 
-func xaddCommand(args []string, client *Client) (string, error) {
+func xaddCommand(args []string, client *Client, reply Reply) error {
 	xreadBlockMutex.Lock()
 	defer xreadBlockMutex.Unlock()
 	defer xreadBlockSignal.Signal()
 
-	var err error
 	if len(args) < 2 {
-		return "", fmt.Errorf("error performing xadd: not enough args")
+		return wrongArgsErr("xadd")
 	}
 
 	streamId := args[0]
-	stream, exists := streamCache[streamId]
-	if !exists {
-		stream = &Stream{}
-		streamCache[streamId] = stream
-	}
-
-	var millisecondsTime int64
-	var sequenceNumber int
 	entryId := args[1]
+	addedEntryId := ""
 
-	if entryId == "*" {
-		millisecondsTime = time.Now().UnixMilli()
-		previousEntry, exists := findMostRecentEntryByTimestamp(*stream, millisecondsTime)
-		if exists {
-			sequenceNumber = previousEntry.sequenceNumber + 1
-		}
-	} else {
-		entryIdParts := strings.Split(entryId, "-")
-		if len(entryIdParts) < 2 {
-			return "", fmt.Errorf("error performing xadd: invalid entry id")
+	err := keyspace.Update(streamId, func(item CacheItem, exists bool) (CacheItem, error) {
+		var err error
+		if exists && item.itemType != "stream" {
+			return item, wrongTypeErr
 		}
-
-		millisecondsTime, err = strconv.ParseInt(entryIdParts[0], 10, 64)
-		if err != nil {
-			return "", fmt.Errorf("error performing xadd: invalid entry id: %w", err)
+		if !exists {
+			item = CacheItem{
+				expiresAt: -1,
+				itemType:  "stream",
+				stream:    &Stream{},
+			}
 		}
+		stream := item.stream
 
-		sequenceNumber = 0
-		if millisecondsTime == 0 {
-			sequenceNumber = 1
-		}
+		var millisecondsTime int64
+		var sequenceNumber int
 
-		if entryIdParts[1] == "*" {
+		if entryId == "*" {
+			millisecondsTime = time.Now().UnixMilli()
 			previousEntry, exists := findMostRecentEntryByTimestamp(*stream, millisecondsTime)
 			if exists {
 				sequenceNumber = previousEntry.sequenceNumber + 1
 			}
 		} else {
-			sequenceNumber, err = strconv.Atoi(entryIdParts[1])
+			entryIdParts := strings.Split(entryId, "-")
+			if len(entryIdParts) != 2 {
+				return item, invalidStreamIdErr
+			}
+
+			millisecondsTime, err = strconv.ParseInt(entryIdParts[0], 10, 64)
 			if err != nil {
-				return "", fmt.Errorf("error performing xadd: invalid entry id: %w", err)
+				return item, invalidStreamIdErr
+			}
+
+			sequenceNumber = 0
+			if millisecondsTime == 0 {
+				sequenceNumber = 1
+			}
+
+			if entryIdParts[1] == "*" {
+				previousEntry, exists := findMostRecentEntryByTimestamp(*stream, millisecondsTime)
+				if exists {
+					sequenceNumber = previousEntry.sequenceNumber + 1
+				}
+			} else {
+				sequenceNumber, err = strconv.Atoi(entryIdParts[1])
+				if err != nil {
+					return item, invalidStreamIdErr
+				}
 			}
 		}
-	}
 
-	if millisecondsTime == 0 && sequenceNumber == 0 && len(stream.entries) > 0 {
-		return xaddEntryIdZeroErr, nil
-	}
+		if millisecondsTime == 0 && sequenceNumber == 0 && len(stream.entries) > 0 {
+			return item, xaddEntryIdZeroErr
+		}
 
-	millisecondsTimeInvalid := stream.lastMillisecondsTime > millisecondsTime
-	sequenceNumberInvalid := stream.lastMillisecondsTime == millisecondsTime &&
-		stream.lastSequenceNumber >= sequenceNumber
-	if millisecondsTimeInvalid || sequenceNumberInvalid {
-		return xaddEntryIdOlderThanLastErr, nil
-	}
+		millisecondsTimeInvalid := stream.lastMillisecondsTime > millisecondsTime
+		sequenceNumberInvalid := stream.lastMillisecondsTime == millisecondsTime &&
+			stream.lastSequenceNumber >= sequenceNumber
+		if millisecondsTimeInvalid || sequenceNumberInvalid {
+			return item, xaddEntryIdOlderThanLastErr
+		}
 
-	stream.lastMillisecondsTime = millisecondsTime
-	stream.lastSequenceNumber = sequenceNumber
+		entry := StreamEntry{
+			timestamp:      millisecondsTime,
+			sequenceNumber: sequenceNumber,
+			values:         map[string]string{},
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			entry.values[args[i]] = args[i+1]
+		}
 
-	entry := StreamEntry{
-		timestamp:      millisecondsTime,
-		sequenceNumber: sequenceNumber,
-		values:         map[string]string{},
-	}
-	stream.entries = append(stream.entries, entry)
+		stream.lastMillisecondsTime = millisecondsTime
+		stream.lastSequenceNumber = sequenceNumber
+		stream.entries = append(stream.entries, entry)
+		markDirty(1)
 
-	for i := 2; i < len(args); i += 2 {
-		key := args[i]
-		value := args[i+1]
-		entry.values[key] = value
+		addedEntryId = fmt.Sprintf("%d-%d", millisecondsTime, sequenceNumber)
+		client.rewrittenCommand = append([]string{"XADD", streamId, addedEntryId}, args[2:]...)
+		return item, nil
+	})
+	if err != nil {
+		return err
 	}
 
-	entryId = fmt.Sprintf("%d-%d", millisecondsTime, sequenceNumber)
-	return toRespStr(entryId), nil
+	reply.Bulk(addedEntryId)
+	return nil
 }
 
-func xrangeCommand(args []string, client *Client) (string, error) {
+func xrangeCommand(args []string, client *Client, reply Reply) error {
 	var err error
 	if len(args) < 3 {
-		return "", fmt.Errorf("error performing xrange: not enough args")
+		return wrongArgsErr("xrange")
 	}
 
 	streamId := args[0]
-	stream, exists := streamCache[streamId]
+	stream, exists := keyspace.GetStream(streamId)
 	if !exists {
-		return "*0\r\n", nil
+		reply.Array(0)
+		return nil
 	}
 
 	startId := args[1]
@@ -396,93 +577,121 @@ func xrangeCommand(args []string, client *Client) (string, error) {
 
 	validEntries, err := getEntriesInRange(*stream, startId, endId)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	innerRespArrs := []string{}
-	for _, entry := range validEntries {
-		entryId := fmt.Sprintf("%d-%d", entry.timestamp, entry.sequenceNumber)
-		respParts := []string{}
+	replyWithStreamEntries(reply, validEntries)
+	return nil
+}
+
+func replyWithStreamEntries(reply Reply, entries []StreamEntry) {
+	reply.Array(len(entries))
+	for _, entry := range entries {
+		reply.Array(2)
+		reply.Bulk(fmt.Sprintf("%d-%d", entry.timestamp, entry.sequenceNumber))
+		reply.Array(len(entry.values) * 2)
 		for key, value := range entry.values {
-			respParts = append(respParts, key, value)
+			reply.Bulk(key)
+			reply.Bulk(value)
 		}
-
-		respStr := "*2\r\n" + toRespStr(entryId) + toRespArr(respParts...)
-		innerRespArrs = append(innerRespArrs, respStr)
 	}
-
-	response := fmt.Sprintf("*%d\r\n", len(innerRespArrs)) + strings.Join(innerRespArrs, "")
-	return response, nil
 }
 
-func xreadCommand(args []string, client *Client) (string, error) {
-	var err error
+func xreadCommand(args []string, client *Client, reply Reply) error {
 	if len(args) < 3 {
-		return "", fmt.Errorf("error performing xread: not enough args")
+		return wrongArgsErr("xread")
 	}
 
-	shouldBlock := args[0] == "block"
-	blockDelayStr := args[1]
+	shouldBlock := false
 	blockDelayMs := int64(0)
-	streamsOffset := 1
-	if shouldBlock {
-		blockDelayMs, err = strconv.ParseInt(blockDelayStr, 10, 64)
-		if err != nil {
-			return "", err
+	streamsOffset := -1
+	for i := 0; i < len(args) && streamsOffset < 0; i++ {
+		switch strings.ToLower(args[i]) {
+		case "block":
+			if i+1 >= len(args) {
+				return syntaxErr
+			}
+			delay, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return replyError("ERR timeout is not an integer or out of range")
+			}
+			if delay < 0 {
+				return replyError("ERR timeout is negative")
+			}
+			shouldBlock = true
+			blockDelayMs = delay
+			i++
+		case "streams":
+			streamsOffset = i + 1
+		default:
+			return syntaxErr
 		}
-		streamsOffset = 3
+	}
+	if streamsOffset < 0 {
+		return syntaxErr
 	}
 
-	streamIds := []string{}
-	for i := streamsOffset; i < len(args); i++ {
-		if strings.Contains(args[i], "-") || args[i] == "$" {
-			break
-		}
-		streamIds = append(streamIds, args[i])
+	// STREAMS is followed by the keys and then one ID per key.
+	streamArgs := args[streamsOffset:]
+	if len(streamArgs) == 0 || len(streamArgs)%2 != 0 {
+		return replyError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
 	}
+	streamIds := streamArgs[:len(streamArgs)/2]
+	givenEntryIds := streamArgs[len(streamArgs)/2:]
 
 	streams := []*Stream{}
 	for _, streamId := range streamIds {
-		stream, exists := streamCache[streamId]
+		stream, exists := keyspace.GetStream(streamId)
 		if !exists {
-			return "*0\r\n", nil
+			reply.Array(0)
+			return nil
 		}
 		streams = append(streams, stream)
 	}
 
-	var timestamp int64
-	var seqNum int
-	givenEntryId := args[len(streamIds)+streamsOffset]
-
-	if givenEntryId == "$" {
-		var exists bool
-		timestamp, seqNum, exists = findMostRecentEntryId(streams[0])
-		if !exists {
-			timestamp = 0
-			seqNum = 0
+	startIds := []string{}
+	for i, givenEntryId := range givenEntryIds {
+		var timestamp int64
+		var seqNum int
+		if givenEntryId == "$" {
+			var exists bool
+			timestamp, seqNum, exists = findMostRecentEntryId(streams[i])
+			if !exists {
+				timestamp = 0
+				seqNum = 0
+			}
+		} else {
+			idParts := strings.Split(givenEntryId, "-")
+			if len(idParts) != 2 {
+				return invalidStreamIdErr
+			}
+			var err error
+			timestamp, err = strconv.ParseInt(idParts[0], 10, 64)
+			if err != nil {
+				return invalidStreamIdErr
+			}
+			seqNum, err = strconv.Atoi(idParts[1])
+			if err != nil {
+				return invalidStreamIdErr
+			}
 		}
-	} else {
-		idParts := strings.Split(givenEntryId, "-")
-		timestamp, err = strconv.ParseInt(idParts[0], 10, 64)
-		if err != nil {
-			return "", err
+
+		if timestamp != 0 {
+			timestamp++
 		}
-		seqNum, err = strconv.Atoi(idParts[1])
-		if err != nil {
-			return "", err
+		if seqNum != 0 {
+			seqNum++
 		}
+		startIds = append(startIds, fmt.Sprintf("%d-%d", timestamp, seqNum))
 	}
 
-	if timestamp != 0 {
-		timestamp++
-	}
-	if seqNum != 0 {
-		seqNum++
-	}
-
-	startId := fmt.Sprintf("%d-%d", timestamp, seqNum)
+	// Like WAIT, a blocking read inside a transaction returns right away.
+	if shouldBlock && !client.inExec {
+		// Replies to earlier pipelined commands shouldn't wait on this one.
+		if err := reply.Flush(); err != nil {
+			return fmt.Errorf("error performing xread: %w", err)
+		}
 
-	if shouldBlock {
 		if blockDelayMs > 0 {
 			time.Sleep(time.Duration(blockDelayMs) * time.Millisecond)
 		} else {
@@ -490,141 +699,254 @@ func xreadCommand(args []string, client *Client) (string, error) {
 			defer xreadBlockMutex.Unlock()
 			xreadBlockSignal.Wait()
 		}
+
+		for i, streamId := range streamIds {
+			if stream, exists := keyspace.GetStream(streamId); exists {
+				streams[i] = stream
+			}
+		}
 	}
 
-	streamRespArrs := []string{}
+	readStreamIds := []string{}
+	readEntries := [][]StreamEntry{}
 	for i, stream := range streams {
-		validEntries, err := getEntriesInRange(*stream, startId, "+")
+		validEntries, err := getEntriesInRange(*stream, startIds[i], "+")
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		if shouldBlock && len(validEntries) == 0 {
 			continue
 		}
+		readStreamIds = append(readStreamIds, streamIds[i])
+		readEntries = append(readEntries, validEntries)
+	}
 
-		innerRespArrs := []string{}
-		for _, entry := range validEntries {
-			entryId := fmt.Sprintf("%d-%d", entry.timestamp, entry.sequenceNumber)
-			respParts := []string{}
-			for key, value := range entry.values {
-				respParts = append(respParts, key, value)
-			}
-
-			respStr := "*2\r\n" + toRespStr(entryId) + toRespArr(respParts...)
-			innerRespArrs = append(innerRespArrs, respStr)
-		}
-
-		streamRespStr := "*2\r\n" + toRespStr(streamIds[i]) + fmt.Sprintf("*%d\r\n", len(innerRespArrs)) + strings.Join(innerRespArrs, "")
-		streamRespArrs = append(streamRespArrs, streamRespStr)
+	if shouldBlock && len(readEntries) == 0 {
+		reply.Null()
+		return nil
 	}
 
-	response := fmt.Sprintf("*%d\r\n", len(streams)) + strings.Join(streamRespArrs, "")
-	if shouldBlock && len(streamRespArrs) == 0 {
-		response = "$-1\r\n"
+	// RESP3 clients get the streams keyed by name rather than as pairs.
+	if reply.Protocol() == 3 {
+		reply.Map(len(readEntries))
+	} else {
+		reply.Array(len(readEntries))
+	}
+	for i, entries := range readEntries {
+		if reply.Protocol() != 3 {
+			reply.Array(2)
+		}
+		reply.Bulk(readStreamIds[i])
+		replyWithStreamEntries(reply, entries)
 	}
 
-	return response, nil
+	return nil
 }
 
-func incrCommand(args []string, client *Client) (string, error) {
+func incrCommand(args []string, client *Client, reply Reply) error {
 	if len(args) == 0 {
-		return "", fmt.Errorf("error performing incr: no args")
+		return wrongArgsErr("incr")
 	}
 
-	key := args[0]
-	item, exists := keyValueCache[key]
-	if !exists {
-		keyValueCache[key] = CacheItem{
-			value:     "1",
-			expiresAt: -1,
-			itemType:  "string",
+	var numberVal int
+	err := keyspace.Update(args[0], func(item CacheItem, exists bool) (CacheItem, error) {
+		if !exists {
+			numberVal = 1
+			return CacheItem{
+				value:     "1",
+				expiresAt: -1,
+				itemType:  "string",
+			}, nil
+		}
+
+		if item.itemType != "string" {
+			return item, wrongTypeErr
 		}
-		return ":1\r\n", nil
-	}
 
-	numberVal, err := strconv.Atoi(item.value)
+		current, err := strconv.Atoi(item.value)
+		if err != nil {
+			return item, errNotInteger
+		}
+
+		numberVal = current + 1
+		item.value = strconv.Itoa(numberVal)
+		return item, nil
+	})
+	if err == errNotInteger {
+		return notIntegerErr
+	}
+	if err == wrongTypeErr {
+		return wrongTypeErr
+	}
 	if err != nil {
-		return incrNotNumErr, nil
+		return fmt.Errorf("error performing incr: %w", err)
 	}
+	markDirty(1)
 
-	item.value = strconv.Itoa(numberVal + 1)
-	keyValueCache[key] = item
-
-	return fmt.Sprintf(":%d\r\n", numberVal+1), nil
+	reply.Int(int64(numberVal))
+	return nil
 }
 
-func multiCommand(args []string, client *Client) (string, error) {
+func multiCommand(args []string, client *Client, reply Reply) error {
 	client.queueFlag = true
 
-	return "+OK\r\n", nil
+	reply.Status("OK")
+	return nil
 }
 
-func execCommand(args []string, client *Client) (string, error) {
+func execCommand(args []string, client *Client, reply Reply) error {
 	defer func() {
 		client.commandQueue = [][]string{}
 		client.queueFlag = false
 	}()
 
 	if !client.queueFlag {
-		return execNotInQueueModeErr, nil
-	}
-
-	if len(client.commandQueue) == 0 {
-		return "*0\r\n", nil
+		return execNotInQueueModeErr
 	}
 
 	client.queueFlag = false
-	responses := []string{}
+	client.inExec = true
+	defer func() { client.inExec = false }()
+
+	reply.Array(len(client.commandQueue))
 	for _, command := range client.commandQueue {
-		queuedArgs := command[1:]
-		if command[1] != "exec" {
-			response, _ := runCommand(command[0], queuedArgs, client)
-			responses = append(responses, response)
+		if err := runCommand(command[0], command[1:], client, reply); err != nil {
+			replyWithCommandError(reply, command[0], err)
 		}
 	}
 
-	response := fmt.Sprintf("*%d\r\n", len(responses)) + strings.Join(responses, "")
-	return response, nil
+	// Replicas and the AOF see the transaction's writes as one MULTI/EXEC
+	// block so they're applied atomically there too.
+	if len(client.propagation) > 0 {
+		client.propagation = append(
+			append([]string{toRespArr("MULTI")}, client.propagation...),
+			toRespArr("EXEC"),
+		)
+	}
+
+	return nil
 }
 
-func discardCommand(args []string, client *Client) (string, error) {
+func discardCommand(args []string, client *Client, reply Reply) error {
 	if !client.queueFlag {
-		return discardNotInQueueModeErr, nil
+		return discardNotInQueueModeErr
 	}
 
 	client.commandQueue = [][]string{}
 	client.queueFlag = false
 
-	return "+OK\r\n", nil
+	reply.Status("OK")
+	return nil
 }
 
-func runCommand(commandName string, args []string, client *Client) (string, error) {
-	commandHandler, exists := commands[commandName]
+func saveCommand(args []string, client *Client, reply Reply) error {
+	if err := saveRdb(); err == errBgsaveInProgress {
+		return bgsaveInProgressErr
+	} else if err != nil {
+		return fmt.Errorf("error performing save: %w", err)
+	}
+
+	reply.Status("OK")
+	return nil
+}
+
+func bgsaveCommand(args []string, client *Client, reply Reply) error {
+	if err := startBgsave(); err == errBgsaveInProgress {
+		return bgsaveInProgressErr
+	} else if err != nil {
+		return fmt.Errorf("error performing bgsave: %w", err)
+	}
+
+	reply.Status("Background saving started")
+	return nil
+}
+
+func lastsaveCommand(args []string, client *Client, reply Reply) error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	reply.Int(int64(lastSaveTime))
+	return nil
+}
+
+func bgrewriteaofCommand(args []string, client *Client, reply Reply) error {
+	if err := startAofRewrite(); err == errAofRewriteInProgress {
+		return aofRewriteInProgressErr
+	} else if err != nil {
+		return fmt.Errorf("error performing bgrewriteaof: %w", err)
+	}
+
+	reply.Status("Background append only file rewriting started")
+	return nil
+}
+
+func replicaofCommand(args []string, client *Client, reply Reply) error {
+	if len(args) != 2 {
+		return wrongArgsErr("replicaof")
+	}
+
+	if strings.ToLower(args[0]) == "no" && strings.ToLower(args[1]) == "one" {
+		becomeMaster()
+		fmt.Println("Promoted to master with replid", getConfig("replId"))
+		reply.Status("OK")
+		return nil
+	}
+
+	if port, err := strconv.Atoi(args[1]); err != nil || port <= 0 || port > 65535 {
+		return replyError("ERR Invalid master port")
+	}
+	if getConfig("role") == "slave" && getConfig("master") == args[0]+" "+args[1] {
+		reply.Status("OK Already connected to specified master")
+		return nil
+	}
+
+	becomeReplicaOf(args[0], args[1])
+	fmt.Printf("Now replicating from %s:%s\n", args[0], args[1])
+	reply.Status("OK")
+	return nil
+}
+
+// Runs a command, writing its reply. An error means nothing was written
+// and the caller should reply with it instead.
+func runCommand(commandName string, args []string, client *Client, reply Reply) error {
+	command, exists := commands[commandName]
 	if !exists {
 		fmt.Printf("Error running command '%s': command does not exist\n", commandName)
+		return replyError(fmt.Sprintf("ERR unknown command '%s'", commandName))
 	}
 
-	fmt.Printf("%s running command: %s %v\n", configParams["role"], commandName, args)
+	if err := clusterRedirect(commandName, args, client); err != nil {
+		if commandName == "exec" {
+			client.queueFlag = false
+			client.commandQueue = [][]string{}
+		}
+		return err
+	}
 
-	response, err := commandHandler(args, client)
-	if err != nil {
-		return "-ERR\r\n", err
+	fmt.Printf("%s running command: %s %v\n", getConfig("role"), commandName, args)
+
+	client.rewrittenCommand = nil
+	if err := command.handler(args, client, reply); err != nil {
+		return err
 	}
 
-	return response, err
-}
+	if command.isWrite {
+		propagated := client.rewrittenCommand
+		if propagated == nil {
+			propagated = append([]string{strings.ToUpper(commandName)}, args...)
+		}
+		client.propagation = append(client.propagation, toRespArr(propagated...))
+	}
 
-func forwardCommandToReplicas(command string) {
-	replicasLock.Lock()
-	defer replicasLock.Unlock()
+	return nil
+}
 
-	for _, replica := range replicas {
-		go func() {
-			if _, innerErr := replica.Write([]byte(command)); innerErr != nil {
-				fmt.Println("Failed to relay command to replica", innerErr.Error())
-				return
-			}
-		}()
+// Errors a handler meant for the client are replied as they are. Anything
+// else is unexpected, so it's logged too.
+func replyWithCommandError(reply Reply, commandName string, err error) {
+	if _, ok := err.(replyError); !ok {
+		fmt.Printf("Error performing command %s: %s\n", commandName, err.Error())
 	}
+	reply.Error(err)
 }
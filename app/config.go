@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var configParams = map[string]string{}
+var configLock = sync.RWMutex{}
+
+var configSetValidators = map[string]func(string) error{
+	"dir":        validateNonEmpty,
+	"dbfilename": validateNonEmpty,
+	"save": func(value string) error {
+		_, err := parseSaveRules(value)
+		return err
+	},
+	"appendfsync":        validateAppendFsync,
+	"aof-load-truncated": validateYesNo,
+	"appendonly":         validateYesNo,
+	"auto-aof-rewrite-percentage": func(value string) error {
+		if percentage, err := strconv.ParseInt(value, 10, 64); err != nil || percentage < 0 {
+			return fmt.Errorf("must be a non-negative integer")
+		}
+		return nil
+	},
+	"auto-aof-rewrite-min-size": func(value string) error {
+		_, err := parseMemory(value)
+		return err
+	},
+	"repl-backlog-size": func(value string) error {
+		if size, err := parseMemory(value); err != nil || size <= 0 {
+			return fmt.Errorf("must be a positive memory amount")
+		}
+		return nil
+	},
+	"repl-timeout":             validatePositiveInt,
+	"repl-ping-replica-period": validatePositiveInt,
+	"min-replicas-to-write":    validateNonNegativeInt,
+	"min-replicas-max-lag":     validateNonNegativeInt,
+	"replica-read-only":        validateYesNo,
+	"repl-diskless-sync":       validateYesNo,
+	"proto-max-bulk-len": func(value string) error {
+		if size, err := parseMemory(value); err != nil || size < 1024*1024 {
+			return fmt.Errorf("must be a memory amount of at least 1mb")
+		}
+		return nil
+	},
+}
+
+var configSetHooks = map[string]func(string) error{
+	"appendonly":         setAppendOnly,
+	"repl-backlog-size":  resizeReplicationBacklog,
+	"proto-max-bulk-len": setProtoMaxBulkLen,
+}
+
+func getConfig(name string) string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	return configParams[name]
+}
+
+func lookupConfig(name string) (string, bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	value, exists := configParams[name]
+	return value, exists
+}
+
+func setConfig(name string, value string) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	configParams[name] = value
+}
+
+func validateNonEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("value can't be empty")
+	}
+
+	return nil
+}
+
+func validatePositiveInt(value string) error {
+	if amount, err := strconv.ParseInt(value, 10, 64); err != nil || amount <= 0 {
+		return fmt.Errorf("must be a positive integer")
+	}
+
+	return nil
+}
+
+func validateNonNegativeInt(value string) error {
+	if amount, err := strconv.ParseInt(value, 10, 64); err != nil || amount < 0 {
+		return fmt.Errorf("must be a non-negative integer")
+	}
+
+	return nil
+}
+
+func parseMemory(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	} {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	amount, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid memory amount %q", value)
+	}
+
+	return amount * multiplier, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const numKeyspaceShards = 16
+
+var errNotInteger = fmt.Errorf("value is not an integer or out of range")
+
+type keyspaceShard struct {
+	lock  sync.RWMutex
+	items map[string]CacheItem
+
+	// Held by write commands from before they run until they've been
+	// logged, so writes to a key reach the AOF and replicas in the order
+	// they were applied.
+	writeOrder sync.Mutex
+}
+
+type Keyspace struct {
+	shards [numKeyspaceShards]*keyspaceShard
+}
+
+var keyspace = newKeyspace()
+
+// Write commands hold writeBarrier for reading while they run and get logged,
+// so taking it for writing gives a snapshot that lines up exactly with the
+// command stream.
+var writeBarrier = sync.RWMutex{}
+
+func newKeyspace() *Keyspace {
+	k := &Keyspace{}
+	for i := range k.shards {
+		k.shards[i] = &keyspaceShard{items: map[string]CacheItem{}}
+	}
+
+	return k
+}
+
+func shardIndex(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return int(hash.Sum32() % numKeyspaceShards)
+}
+
+func (k *Keyspace) shardFor(key string) *keyspaceShard {
+	return k.shards[shardIndex(key)]
+}
+
+// LockWriteOrder takes the write order locks of every shard the keys live
+// in, always in shard order so that transactions can't deadlock each other.
+// The returned function releases them.
+func (k *Keyspace) LockWriteOrder(keys []string) func() {
+	locked := [numKeyspaceShards]bool{}
+	for _, key := range keys {
+		locked[shardIndex(key)] = true
+	}
+
+	for i, shard := range k.shards {
+		if locked[i] {
+			shard.writeOrder.Lock()
+		}
+	}
+
+	return func() {
+		for i, shard := range k.shards {
+			if locked[i] {
+				shard.writeOrder.Unlock()
+			}
+		}
+	}
+}
+
+func isExpired(item CacheItem, now int64) bool {
+	return item.expiresAt != -1 && now >= item.expiresAt
+}
+
+// Streams are shared by pointer, so readers get a copy of the stream header
+// that later appends made under the shard lock can't change underneath them.
+func snapshotItem(item CacheItem) CacheItem {
+	if item.stream != nil {
+		stream := *item.stream
+		item.stream = &stream
+	}
+
+	return item
+}
+
+func (k *Keyspace) Get(key string) (CacheItem, bool) {
+	shard := k.shardFor(key)
+	now := time.Now().UnixMilli()
+
+	shard.lock.RLock()
+	item, exists := shard.items[key]
+	if exists && !isExpired(item, now) {
+		item = snapshotItem(item)
+		shard.lock.RUnlock()
+		return item, true
+	}
+	shard.lock.RUnlock()
+
+	if exists {
+		shard.lock.Lock()
+		if item, exists := shard.items[key]; exists && isExpired(item, now) {
+			delete(shard.items, key)
+		}
+		shard.lock.Unlock()
+	}
+
+	return CacheItem{}, false
+}
+
+func (k *Keyspace) Set(key string, item CacheItem) {
+	shard := k.shardFor(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	shard.items[key] = item
+}
+
+func (k *Keyspace) Delete(key string) bool {
+	shard := k.shardFor(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	_, exists := shard.items[key]
+	delete(shard.items, key)
+
+	return exists
+}
+
+// Update holds the shard lock across fn so read-modify-write commands stay atomic.
+func (k *Keyspace) Update(key string, fn func(item CacheItem, exists bool) (CacheItem, error)) error {
+	shard := k.shardFor(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	item, exists := shard.items[key]
+	if exists && isExpired(item, time.Now().UnixMilli()) {
+		delete(shard.items, key)
+		item, exists = CacheItem{}, false
+	}
+
+	updated, err := fn(item, exists)
+	if err != nil {
+		return err
+	}
+
+	shard.items[key] = updated
+	return nil
+}
+
+func (k *Keyspace) Keys() []string {
+	now := time.Now().UnixMilli()
+	keys := []string{}
+
+	for _, shard := range k.shards {
+		shard.lock.RLock()
+		for key, item := range shard.items {
+			if !isExpired(item, now) {
+				keys = append(keys, key)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+
+	return keys
+}
+
+func (k *Keyspace) GetStream(key string) (*Stream, bool) {
+	item, exists := k.Get(key)
+	if !exists || item.itemType != "stream" {
+		return nil, false
+	}
+
+	return item.stream, true
+}
+
+func (k *Keyspace) Snapshot() map[string]CacheItem {
+	now := time.Now().UnixMilli()
+	items := map[string]CacheItem{}
+
+	for _, shard := range k.shards {
+		shard.lock.RLock()
+		for key, item := range shard.items {
+			if !isExpired(item, now) {
+				items[key] = snapshotItem(item)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+
+	return items
+}
+
+func (k *Keyspace) Flush() {
+	for _, shard := range k.shards {
+		shard.lock.Lock()
+		shard.items = map[string]CacheItem{}
+		shard.lock.Unlock()
+	}
+}
@@ -2,18 +2,109 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"net"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func performHandshake(conn net.Conn, reader *bufio.Reader) error {
+const masterDialTimeout = 5 * time.Second
+const masterReconnectMinBackoff = 100 * time.Millisecond
+const masterReconnectMaxBackoff = 10 * time.Second
+const snapshotChunkSize = 64 * 1024
+
+var masterLinkLock = sync.Mutex{}
+var masterLinkUp = false
+var masterSyncInProgress = false
+var masterLastIo = time.Time{}
+var masterConn net.Conn
+var masterSyncTotalBytes = int64(0)
+var masterSyncReadBytes = int64(0)
+var replicationLoopRunning = false
+
+// The replid of the master we last synced with, used together with
+// bytesProcessed to ask for a partial resync after the link drops.
+var masterReplId = ""
+
+// Every read from the master counts as I/O for master_last_io_seconds_ago,
+// including the replication stream and the snapshot transfer. The master
+// PINGs at least every repl-ping-replica-period, so a link that stays silent
+// for repl-timeout is dead and the read fails.
+type masterConnReader struct {
+	conn net.Conn
+}
+
+func (r masterConnReader) Read(p []byte) (int, error) {
+	if timeout, err := strconv.ParseInt(getConfig("repl-timeout"), 10, 64); err == nil && timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		masterLinkLock.Lock()
+		masterLastIo = time.Now()
+		masterLinkLock.Unlock()
+	}
+	return n, err
+}
+
+func setMasterLinkState(up bool, syncInProgress bool) {
+	masterLinkLock.Lock()
+	defer masterLinkLock.Unlock()
+
+	masterLinkUp = up
+	masterSyncInProgress = syncInProgress
+}
+
+func masterLinkIsUp() bool {
+	masterLinkLock.Lock()
+	defer masterLinkLock.Unlock()
 
-	rdbMutex.Lock()
-	defer rdbMutex.Unlock()
+	return masterLinkUp
+}
+
+func addMasterLinkInfo(response *string) {
+	masterLinkLock.Lock()
+	defer masterLinkLock.Unlock()
+
+	parts := strings.Split(getConfig("master"), " ")
+	if len(parts) == 2 {
+		addToInfoResponse("master_host", parts[0], response)
+		addToInfoResponse("master_port", parts[1], response)
+	}
+
+	linkStatus := "down"
+	if masterLinkUp {
+		linkStatus = "up"
+	}
+	addToInfoResponse("master_link_status", linkStatus, response)
+
+	lastIo := int64(-1)
+	if !masterLastIo.IsZero() {
+		lastIo = int64(time.Since(masterLastIo).Seconds())
+	}
+	addToInfoResponse("master_last_io_seconds_ago", strconv.FormatInt(lastIo, 10), response)
 
+	syncInProgress := "0"
+	if masterSyncInProgress {
+		syncInProgress = "1"
+	}
+	addToInfoResponse("master_sync_in_progress", syncInProgress, response)
+	if masterSyncInProgress {
+		addToInfoResponse("master_sync_total_bytes", strconv.FormatInt(masterSyncTotalBytes, 10), response)
+		addToInfoResponse("master_sync_read_bytes", strconv.FormatInt(masterSyncReadBytes, 10), response)
+	}
+	addToInfoResponse("slave_repl_offset", strconv.FormatInt(bytesProcessed.Load(), 10), response)
+	if masterReplId != "" {
+		addToInfoResponse("master_replid", masterReplId, response)
+	}
+}
+
+func performHandshake(conn net.Conn, reader *bufio.Reader) error {
 	if _, err := conn.Write([]byte("*1\r\n" + toRespStr("PING"))); err != nil {
 		return fmt.Errorf("error making ping: %w", err)
 	}
@@ -21,8 +112,8 @@ func performHandshake(conn net.Conn, reader *bufio.Reader) error {
 		return fmt.Errorf("error making ping: %w", err)
 	}
 
-	replconfPort := "*3\r\n" + toRespStr("REPLCONF") + toRespStr("listening-port") + toRespStr(configParams["port"])
-	replconfCapa := "*3\r\n" + toRespStr("REPLCONF") + toRespStr("capa") + toRespStr("psync2")
+	replconfPort := "*3\r\n" + toRespStr("REPLCONF") + toRespStr("listening-port") + toRespStr(getConfig("port"))
+	replconfCapa := toRespArr("REPLCONF", "capa", "eof", "capa", "psync2")
 	if _, err := conn.Write([]byte(replconfPort)); err != nil {
 		return fmt.Errorf("error making replconf: %w", err)
 	}
@@ -36,58 +127,338 @@ func performHandshake(conn net.Conn, reader *bufio.Reader) error {
 		return fmt.Errorf("error making replconf: %w", err)
 	}
 
-	psync := "*3\r\n" + toRespStr("PSYNC") + toRespStr("?") + toRespStr("-1")
+	masterLinkLock.Lock()
+	psyncReplId, psyncOffset := "?", "-1"
+	if masterReplId != "" {
+		psyncReplId = masterReplId
+		psyncOffset = strconv.FormatInt(bytesProcessed.Load()+1, 10)
+	}
+	masterLinkLock.Unlock()
+
+	psync := "*3\r\n" + toRespStr("PSYNC") + toRespStr(psyncReplId) + toRespStr(psyncOffset)
 	if _, err := conn.Write([]byte(psync)); err != nil {
 		return fmt.Errorf("error making psync: %w", err)
 	}
 
-	if response, err := readResp(reader); response[:11] != "+FULLRESYNC" || err != nil {
+	response, err := readResp(reader)
+	if err != nil {
 		return fmt.Errorf("error making psync: %w", err)
 	}
 
-	lengthStr, err := readResp(reader)
-	if err != nil {
-		return fmt.Errorf("error receiving rdb file length: %w", err)
+	fields := strings.Fields(response)
+	switch {
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		// The master may have been promoted since, in which case it tells us
+		// its new replid and the stream simply carries on.
+		if len(fields) == 2 {
+			masterLinkLock.Lock()
+			masterReplId = fields[1]
+			masterLinkLock.Unlock()
+			inheritReplicationId(fields[1])
+		}
+		fmt.Printf("Partial resync with master, continuing from offset %d\n", bytesProcessed.Load())
+		return nil
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("error making psync: invalid offset: %w", err)
+		}
+		if err := receiveSnapshot(reader); err != nil {
+			return err
+		}
+
+		masterLinkLock.Lock()
+		masterReplId = fields[1]
+		bytesProcessed.Store(offset)
+		masterLinkLock.Unlock()
+		resetReplicationHistory(fields[1], offset)
+		restartAofAfterSync()
+		return nil
 	}
 
-	length, err := strconv.Atoi(lengthStr[1:])
+	return fmt.Errorf("error making psync: unexpected response %q", response)
+}
+
+func receiveSnapshot(reader *bufio.Reader) error {
+	header, err := readResp(reader)
 	if err != nil {
 		return fmt.Errorf("error receiving rdb file length: %w", err)
 	}
+	if !strings.HasPrefix(header, "$") {
+		return fmt.Errorf("error receiving rdb file: unexpected header %q", header)
+	}
 
-	buffer := make([]byte, length)
-	if _, err := reader.Read(buffer); err != nil {
+	var data []byte
+	if eofMark, found := strings.CutPrefix(header, "$EOF:"); found {
+		if len(eofMark) != rdbEofMarkSize {
+			return fmt.Errorf("error receiving rdb file: invalid EOF mark %q", eofMark)
+		}
+		data, err = readSnapshotUntilMark(reader, []byte(eofMark))
+	} else {
+		length, convErr := strconv.ParseInt(header[1:], 10, 64)
+		if convErr != nil || length < 0 {
+			return fmt.Errorf("error receiving rdb file length: invalid length %q", header)
+		}
+		data, err = readSnapshot(reader, length)
+	}
+	if err != nil {
 		return fmt.Errorf("error receiving rdb file: %w", err)
 	}
 
-	rdbFile = buffer
+	// A payload that doesn't parse leaves the current keyspace in place.
+	parsed, err := parseRdb(data)
+	if err != nil {
+		return fmt.Errorf("error loading rdb file from master: %w", err)
+	}
+	keyspace.Flush()
+	applyRdb(parsed)
 
 	return nil
 }
 
-func connectToMaster() {
-	parts := strings.Split(configParams["master"], " ")
-	conn, err := net.Dial("tcp", parts[0]+":"+parts[1])
+func readSnapshot(reader *bufio.Reader, length int64) ([]byte, error) {
+	progress := newSnapshotProgress(length)
+	data := make([]byte, length)
+	for read := int64(0); read < length; {
+		chunk := min(length-read, snapshotChunkSize)
+		if _, err := io.ReadFull(reader, data[read:read+chunk]); err != nil {
+			return nil, err
+		}
+		read += chunk
+		progress.update(read)
+	}
+
+	return data, nil
+}
+
+// With the EOF format the snapshot ends where the mark first shows up. Only
+// bytes up to the mark are consumed, as the replication stream follows it
+// directly on the same connection.
+func readSnapshotUntilMark(reader *bufio.Reader, mark []byte) ([]byte, error) {
+	progress := newSnapshotProgress(-1)
+	data := []byte{}
+	for {
+		if reader.Buffered() == 0 {
+			if _, err := reader.Peek(1); err != nil {
+				return nil, err
+			}
+		}
+		window, _ := reader.Peek(reader.Buffered())
+
+		overlap := max(0, len(data)-(len(mark)-1))
+		search := append(data[overlap:len(data):len(data)], window...)
+		if idx := bytes.Index(search, mark); idx >= 0 {
+			consumed := idx + len(mark) - (len(data) - overlap)
+			data = append(data, window[:consumed]...)
+			reader.Discard(consumed)
+			progress.update(int64(len(data)))
+			return data[:len(data)-len(mark)], nil
+		}
+
+		data = append(data, window...)
+		reader.Discard(len(window))
+		progress.update(int64(len(data)))
+	}
+}
+
+type snapshotProgress struct {
+	total      int64
+	lastReport time.Time
+}
+
+func newSnapshotProgress(total int64) *snapshotProgress {
+	masterLinkLock.Lock()
+	masterSyncTotalBytes = total
+	masterSyncReadBytes = 0
+	masterLinkLock.Unlock()
+
+	return &snapshotProgress{total: total, lastReport: time.Now()}
+}
+
+func (p *snapshotProgress) update(read int64) {
+	masterLinkLock.Lock()
+	masterSyncReadBytes = read
+	masterLinkLock.Unlock()
+
+	if time.Since(p.lastReport) >= time.Second || read == p.total {
+		p.lastReport = time.Now()
+		if p.total >= 0 {
+			fmt.Printf("Receiving snapshot from master: %d/%d bytes\n", read, p.total)
+		} else {
+			fmt.Printf("Receiving snapshot from master: %d bytes\n", read)
+		}
+	}
+}
+
+func startReplicationLoop() {
+	masterLinkLock.Lock()
+	defer masterLinkLock.Unlock()
+
+	startReplicationLoopLocked()
+}
+
+func startReplicationLoopLocked() {
+	if !replicationLoopRunning {
+		replicationLoopRunning = true
+		go runReplicationLoop()
+	}
+}
+
+// The replica keeps serving (possibly stale) reads while the link is down and
+// retries with exponential backoff until the master is reachable again. The
+// loop ends once REPLICAOF NO ONE turns us back into a master.
+func runReplicationLoop() {
+	backoff := masterReconnectMinBackoff
+	for {
+		masterLinkLock.Lock()
+		if getConfig("role") != "slave" {
+			replicationLoopRunning = false
+			masterLinkLock.Unlock()
+			return
+		}
+		masterLinkLock.Unlock()
+
+		if synced := syncWithMaster(); synced {
+			backoff = masterReconnectMinBackoff
+		} else {
+			backoff = min(backoff*2, masterReconnectMaxBackoff)
+		}
+
+		fmt.Printf("Reconnecting to master in %s\n", backoff)
+		time.Sleep(backoff)
+	}
+}
+
+func syncWithMaster() bool {
+	parts := strings.Split(getConfig("master"), " ")
+	if len(parts) != 2 {
+		fmt.Printf("Invalid master address %q\n", getConfig("master"))
+		return false
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(parts[0], parts[1]), masterDialTimeout)
 	if err != nil {
-		fmt.Printf("Failed to connect to master (%s:%s)\n", parts[0], parts[1])
-		os.Exit(1)
+		fmt.Printf("Failed to connect to master (%s:%s): %s\n", parts[0], parts[1], err.Error())
+		return false
 	}
 	fmt.Printf("Connected to master (%s:%s)\n", parts[0], parts[1])
 
-	reader := bufio.NewReader(conn)
+	// REPLICAOF may have changed the topology while we were dialing.
+	masterLinkLock.Lock()
+	if getConfig("role") != "slave" || getConfig("master") != strings.Join(parts, " ") {
+		masterLinkLock.Unlock()
+		conn.Close()
+		return true
+	}
+	masterConn = conn
+	masterLinkLock.Unlock()
 
+	defer func() {
+		masterLinkLock.Lock()
+		masterConn = nil
+		masterLinkLock.Unlock()
+	}()
+
+	reader := bufio.NewReader(masterConnReader{conn: conn})
+
+	setMasterLinkState(false, true)
 	if err := performHandshake(conn, reader); err != nil {
 		fmt.Println("Error performing handshake (will close)", err.Error())
+		setMasterLinkState(false, false)
 		if err := conn.Close(); err != nil {
 			fmt.Println("Error closing connection to master", err.Error())
 		}
-		return
+		return false
 	}
+	setMasterLinkState(true, false)
+
+	stopAcks := make(chan struct{})
+	defer close(stopAcks)
+	go sendAcksToMaster(conn, stopAcks)
 
 	client := Client{
 		conn:         conn,
 		queueFlag:    false,
 		commandQueue: [][]string{},
+		fromMaster:   true,
 	}
+	client.replyWriter = newRespWriter(conn, &client)
 	handleClient(&client, reader)
+
+	setMasterLinkState(false, false)
+	fmt.Println("Lost connection to master")
+	return true
+}
+
+// A master turned into a replica starts over with a full resync, dropping its
+// own replicas since their history no longer matches ours. A replica switched
+// to another master keeps its replid and offset so the new master (which may
+// just have been promoted from a fellow replica) can accept a partial resync.
+func becomeReplicaOf(host string, port string) {
+	masterLinkLock.Lock()
+	defer masterLinkLock.Unlock()
+
+	address := host + " " + port
+	if getConfig("role") == "master" {
+		masterReplId = ""
+		bytesProcessed.Store(0)
+		disconnectReplicas()
+	}
+
+	setConfig("master", address)
+	setConfig("role", "slave")
+	if masterConn != nil {
+		masterConn.Close()
+	}
+	startReplicationLoopLocked()
+}
+
+// Promotion keeps the replication history: the replid we inherited becomes
+// replid2 so replicas of the old master can partially resync with us up to
+// the offset we had reached.
+func becomeMaster() {
+	masterLinkLock.Lock()
+	defer masterLinkLock.Unlock()
+
+	if getConfig("role") == "master" {
+		return
+	}
+
+	setConfig("role", "master")
+	if masterConn != nil {
+		masterConn.Close()
+	}
+
+	// Our replicas reconnect to learn the new replid, continuing from where
+	// they were under the old one.
+	disconnectReplicas()
+
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	if replId := getConfig("replId"); replId != "" {
+		setConfig("replId2", replId)
+		secondReplOffset = masterReplOffset + 1
+	}
+	setConfig("replId", generateReplId())
+}
+
+// The heartbeat lets the master notice a dead replica and report its lag
+// even when no GETACK is ever sent.
+func sendAcksToMaster(conn net.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ack := toRespArr("REPLCONF", "ACK", strconv.FormatInt(bytesProcessed.Load(), 10))
+			if _, err := conn.Write([]byte(ack)); err != nil {
+				fmt.Println("Error sending ACK to master:", err.Error())
+				return
+			}
+		}
+	}
 }
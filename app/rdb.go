@@ -2,114 +2,957 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"os"
-	"sync"
+	"strconv"
+	"time"
 )
 
-var rdbFile = []byte{}
-var rdbMutex = sync.Mutex{}
+const (
+	rdbOpFunctionPreGa = 0xF6
+	rdbOpFunction2     = 0xF5
+	rdbOpModuleAux     = 0xF7
+	rdbOpIdle          = 0xF8
+	rdbOpFreq          = 0xF9
+	rdbOpAux           = 0xFA
+	rdbOpResizeDb      = 0xFB
+	rdbOpExpireTimeMs  = 0xFC
+	rdbOpExpireTime    = 0xFD
+	rdbOpSelectDb      = 0xFE
+	rdbOpEof           = 0xFF
 
-type ValueInfo struct {
-	position  int
-	expiresAt int64
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeZset2            = 5
+	rdbTypeModulePreGa      = 6
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZsetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLzf   = 3
+
+	rdbModuleOpcodeEof    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+
+	rdbMinVersion = 1
+	rdbMaxVersion = 11
+)
+
+var errRdbSkipValue = errors.New("rdb value type cannot be represented")
+
+type rdbData struct {
+	version   int
+	size      int
+	aux       map[string]string
+	databases map[int]map[string]CacheItem
+}
+
+type rdbReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("unexpected end of rdb at offset %d", r.pos)
+	}
+
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *rdbReader) readBytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("unexpected end of rdb at offset %d", r.pos)
+	}
+
+	bytes := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return bytes, nil
+}
+
+func (r *rdbReader) readLengthWithEncoding() (uint64, bool, error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first & 0xC0 {
+	case 0x00:
+		return uint64(first & 0x3F), false, nil
+	case 0x40:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case 0xC0:
+		return uint64(first & 0x3F), true, nil
+	}
+
+	switch first {
+	case 0x80:
+		raw, err := r.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(raw)), false, nil
+	case 0x81:
+		raw, err := r.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(raw), false, nil
+	}
+
+	return 0, false, fmt.Errorf("unsupported length encoding 0x%x at offset %d", first, r.pos-1)
+}
+
+func (r *rdbReader) readUint64() (uint64, error) {
+	length, encoded, err := r.readLengthWithEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding where length expected at offset %d", r.pos-1)
+	}
+
+	return length, nil
+}
+
+func (r *rdbReader) readLength() (int, error) {
+	length, err := r.readUint64()
+	if err != nil {
+		return 0, err
+	}
+	if length > math.MaxInt32 {
+		return 0, fmt.Errorf("length %d too large at offset %d", length, r.pos)
+	}
+
+	return int(length), nil
+}
+
+func (r *rdbReader) readStringBytes() ([]byte, error) {
+	length, encoded, err := r.readLengthWithEncoding()
+	if err != nil {
+		return nil, err
+	}
+
+	if !encoded {
+		return r.readBytes(int(length))
+	}
+
+	switch length {
+	case rdbEncInt8:
+		raw, err := r.readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int8(raw[0])))), nil
+	case rdbEncInt16:
+		raw, err := r.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(raw))))), nil
+	case rdbEncInt32:
+		raw, err := r.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(raw))))), nil
+	case rdbEncLzf:
+		compressedLength, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := r.readBytes(compressedLength)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, length)
+	}
+
+	return nil, fmt.Errorf("unsupported string encoding %d at offset %d", length, r.pos-1)
+}
+
+func (r *rdbReader) readString() (string, error) {
+	raw, err := r.readStringBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(raw), nil
+}
+
+func (r *rdbReader) readMillisecondTime() (int64, error) {
+	raw, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint64(raw)), nil
+}
+
+func (r *rdbReader) readTextDouble() (float64, error) {
+	length, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+
+	raw, err := r.readBytes(int(length))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(string(raw), 64)
+}
+
+func (r *rdbReader) readBinaryDouble() (float64, error) {
+	raw, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(binary.LittleEndian.Uint64(raw)), nil
 }
 
-func decodeString(raw []byte, start int) (string, int) {
-	idx := start
-	var size uint32 = 0
-	if raw[start]&0xC0 == 0x0 {
-		size = uint32(raw[start])
-		idx += 1
-	} else if raw[start]&0xC0 == 0x40 {
-		size = binary.BigEndian.Uint32([]byte{raw[start] & 0x3F, raw[start+1]})
-		idx += 2
-	} else if raw[start]&0xC0 == 0x80 {
-		size = binary.BigEndian.Uint32(raw[start+1 : start+5])
-		idx += 5
+func (r *rdbReader) readStreamId() (int64, int, error) {
+	raw, err := r.readStringBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(raw) != 16 {
+		return 0, 0, fmt.Errorf("invalid stream id of %d bytes", len(raw))
 	}
 
-	end := idx + int(size)
-	return string(raw[idx:end]), end
+	return int64(binary.BigEndian.Uint64(raw[:8])), int(binary.BigEndian.Uint64(raw[8:])), nil
 }
 
-func initRdbFile() error {
-	rdbMutex.Lock()
-	defer rdbMutex.Unlock()
+func (r *rdbReader) skipModuleValue() error {
+	for {
+		opcode, err := r.readLength()
+		if err != nil {
+			return err
+		}
 
-	if len(rdbFile) == 0 {
-		if configParams["dir"] == "" || configParams["dbfilename"] == "" {
-			fmt.Println("error getting keys: directory or filename not in config")
+		switch opcode {
+		case rdbModuleOpcodeEof:
 			return nil
+		case rdbModuleOpcodeSint, rdbModuleOpcodeUint:
+			_, err = r.readUint64()
+		case rdbModuleOpcodeFloat:
+			_, err = r.readBytes(4)
+		case rdbModuleOpcodeDouble:
+			_, err = r.readBytes(8)
+		case rdbModuleOpcodeString:
+			_, err = r.readStringBytes()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *rdbReader) readStrings() ([]string, error) {
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	strs := make([]string, 0, length)
+	for i := 0; i < length; i++ {
+		str, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+
+	return strs, nil
+}
+
+func (r *rdbReader) readEncodedBlob(parse func([]byte) ([]string, error)) ([]string, error) {
+	raw, err := r.readStringBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return parse(raw)
+}
+
+func toSet(members []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+
+	return set
+}
+
+func pairsToHash(pairs []string) (map[string]string, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hash entries")
+	}
+
+	hash := make(map[string]string, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		hash[pairs[i]] = pairs[i+1]
+	}
+
+	return hash, nil
+}
+
+func pairsToZset(pairs []string) (map[string]float64, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of zset entries")
+	}
+
+	zset := make(map[string]float64, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zset score: %w", err)
+		}
+		zset[pairs[i]] = score
+	}
+
+	return zset, nil
+}
+
+func (r *rdbReader) readValue(valueType byte) (CacheItem, error) {
+	item := CacheItem{expiresAt: -1}
+
+	switch valueType {
+	case rdbTypeString:
+		value, err := r.readString()
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "string"
+		item.value = value
+	case rdbTypeList:
+		list, err := r.readStrings()
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "list"
+		item.list = list
+	case rdbTypeSet:
+		members, err := r.readStrings()
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "set"
+		item.set = toSet(members)
+	case rdbTypeZset, rdbTypeZset2:
+		length, err := r.readLength()
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "zset"
+		item.zset = make(map[string]float64, length)
+		for i := 0; i < length; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return item, err
+			}
+			var score float64
+			if valueType == rdbTypeZset {
+				score, err = r.readTextDouble()
+			} else {
+				score, err = r.readBinaryDouble()
+			}
+			if err != nil {
+				return item, err
+			}
+			item.zset[member] = score
+		}
+	case rdbTypeHash:
+		length, err := r.readLength()
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "hash"
+		item.hash = make(map[string]string, length)
+		for i := 0; i < length; i++ {
+			field, err := r.readString()
+			if err != nil {
+				return item, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return item, err
+			}
+			item.hash[field] = value
+		}
+	case rdbTypeHashZipmap:
+		raw, err := r.readStringBytes()
+		if err != nil {
+			return item, err
+		}
+		hash, err := parseZipmap(raw)
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "hash"
+		item.hash = hash
+	case rdbTypeListZiplist:
+		list, err := r.readEncodedBlob(parseZiplist)
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "list"
+		item.list = list
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		parse := parseIntset
+		if valueType == rdbTypeSetListpack {
+			parse = parseListpack
+		}
+		members, err := r.readEncodedBlob(parse)
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "set"
+		item.set = toSet(members)
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		parse := parseZiplist
+		if valueType == rdbTypeZsetListpack {
+			parse = parseListpack
+		}
+		pairs, err := r.readEncodedBlob(parse)
+		if err != nil {
+			return item, err
+		}
+		zset, err := pairsToZset(pairs)
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "zset"
+		item.zset = zset
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		parse := parseZiplist
+		if valueType == rdbTypeHashListpack {
+			parse = parseListpack
+		}
+		pairs, err := r.readEncodedBlob(parse)
+		if err != nil {
+			return item, err
+		}
+		hash, err := pairsToHash(pairs)
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "hash"
+		item.hash = hash
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		nodes, err := r.readLength()
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "list"
+		item.list = []string{}
+		for i := 0; i < nodes; i++ {
+			container := rdbQuicklistNodePacked
+			if valueType == rdbTypeListQuicklist2 {
+				container, err = r.readLength()
+				if err != nil {
+					return item, err
+				}
+			}
+
+			raw, err := r.readStringBytes()
+			if err != nil {
+				return item, err
+			}
+
+			var entries []string
+			switch {
+			case container == rdbQuicklistNodePlain:
+				entries = []string{string(raw)}
+			case valueType == rdbTypeListQuicklist:
+				entries, err = parseZiplist(raw)
+			default:
+				entries, err = parseListpack(raw)
+			}
+			if err != nil {
+				return item, err
+			}
+			item.list = append(item.list, entries...)
+		}
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		stream, err := r.readStream(valueType)
+		if err != nil {
+			return item, err
+		}
+		item.itemType = "stream"
+		item.stream = stream
+	case rdbTypeModule2:
+		if _, err := r.readUint64(); err != nil {
+			return item, err
+		}
+		if err := r.skipModuleValue(); err != nil {
+			return item, err
+		}
+		return item, errRdbSkipValue
+	case rdbTypeModulePreGa:
+		return item, fmt.Errorf("pre-GA module values are not supported")
+	default:
+		return item, fmt.Errorf("unknown value type %d", valueType)
+	}
+
+	return item, nil
+}
+
+func (r *rdbReader) readStream(valueType byte) (*Stream, error) {
+	stream := &Stream{}
+
+	numListpacks, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < numListpacks; i++ {
+		masterTimestamp, masterSeqNum, err := r.readStreamId()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := r.readStringBytes()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseListpack(raw)
+		if err != nil {
+			return nil, err
 		}
 
-		var err error
-		contents, err := os.ReadFile(configParams["dir"] + "/" + configParams["dbfilename"])
+		parsed, err := parseStreamListpack(entries, masterTimestamp, masterSeqNum)
 		if err != nil {
-			return fmt.Errorf("error initializing rdb file: %w", err)
+			return nil, err
+		}
+		stream.entries = append(stream.entries, parsed...)
+	}
+
+	if _, err := r.readUint64(); err != nil {
+		return nil, err
+	}
+	lastTimestamp, err := r.readUint64()
+	if err != nil {
+		return nil, err
+	}
+	lastSeqNum, err := r.readUint64()
+	if err != nil {
+		return nil, err
+	}
+	stream.lastMillisecondsTime = int64(lastTimestamp)
+	stream.lastSequenceNumber = int(lastSeqNum)
+
+	if valueType >= rdbTypeStreamListpacks2 {
+		// first id, max deleted id and entries added
+		for i := 0; i < 5; i++ {
+			if _, err := r.readUint64(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	numGroups, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numGroups; i++ {
+		if err := r.skipConsumerGroup(valueType); err != nil {
+			return nil, fmt.Errorf("error reading consumer group: %w", err)
+		}
+	}
+
+	return stream, nil
+}
+
+func (r *rdbReader) skipConsumerGroup(valueType byte) error {
+	if _, err := r.readStringBytes(); err != nil {
+		return err
+	}
+	lengthsToSkip := 2
+	if valueType >= rdbTypeStreamListpacks2 {
+		lengthsToSkip = 3
+	}
+	for i := 0; i < lengthsToSkip; i++ {
+		if _, err := r.readUint64(); err != nil {
+			return err
+		}
+	}
+
+	pendingEntries, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < pendingEntries; i++ {
+		if _, err := r.readBytes(16 + 8); err != nil {
+			return err
+		}
+		if _, err := r.readUint64(); err != nil {
+			return err
 		}
+	}
 
-		rdbFile = contents
+	consumers, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < consumers; i++ {
+		if _, err := r.readStringBytes(); err != nil {
+			return err
+		}
+		timestamps := 8
+		if valueType >= rdbTypeStreamListpacks3 {
+			timestamps = 16
+		}
+		if _, err := r.readBytes(timestamps); err != nil {
+			return err
+		}
+		consumerPending, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		if _, err := r.readBytes(16 * consumerPending); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func getKeys() (map[string]ValueInfo, error) {
-	if err := initRdbFile(); err != nil {
-		return make(map[string]ValueInfo), fmt.Errorf("error getting keys: %w", err)
+func parseStreamListpack(lp []string, masterTimestamp int64, masterSeqNum int) ([]StreamEntry, error) {
+	ints := func(strs ...string) ([]int64, error) {
+		values := make([]int64, 0, len(strs))
+		for _, str := range strs {
+			value, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stream listpack integer: %w", err)
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	if len(lp) < 3 {
+		return nil, fmt.Errorf("stream listpack missing master entry")
+	}
+	header, err := ints(lp[0], lp[1], lp[2])
+	if err != nil {
+		return nil, err
 	}
+	numMasterFields := int(header[2])
+	if len(lp) < 4+numMasterFields {
+		return nil, fmt.Errorf("stream listpack master entry truncated")
+	}
+	masterFields := lp[3 : 3+numMasterFields]
+
+	entries := []StreamEntry{}
+	idx := 4 + numMasterFields
+	for idx < len(lp) {
+		if idx+3 > len(lp) {
+			return nil, fmt.Errorf("stream listpack entry truncated")
+		}
+		entryHeader, err := ints(lp[idx], lp[idx+1], lp[idx+2])
+		if err != nil {
+			return nil, err
+		}
+		flags := entryHeader[0]
+		idx += 3
+
+		entry := StreamEntry{
+			timestamp:      masterTimestamp + entryHeader[1],
+			sequenceNumber: masterSeqNum + int(entryHeader[2]),
+			values:         map[string]string{},
+		}
+
+		if flags&2 != 0 {
+			if idx+numMasterFields > len(lp) {
+				return nil, fmt.Errorf("stream listpack entry truncated")
+			}
+			for i, field := range masterFields {
+				entry.values[field] = lp[idx+i]
+			}
+			idx += numMasterFields
+		} else {
+			numFields, err := ints(lp[idx])
+			if err != nil {
+				return nil, err
+			}
+			idx++
+			if idx+int(numFields[0])*2 > len(lp) {
+				return nil, fmt.Errorf("stream listpack entry truncated")
+			}
+			for i := 0; i < int(numFields[0]); i++ {
+				entry.values[lp[idx+2*i]] = lp[idx+2*i+1]
+			}
+			idx += int(numFields[0]) * 2
+		}
 
-	rdbMutex.Lock()
-	defer rdbMutex.Unlock()
+		// skip the lp-count trailer
+		idx++
 
-	dbStartIdx := -1
-	for i, b := range rdbFile {
-		if b == 0xFE {
-			dbStartIdx = i
-			break
+		if flags&1 == 0 {
+			entries = append(entries, entry)
 		}
 	}
 
-	if dbStartIdx == -1 {
-		return nil, fmt.Errorf("error getting keys: no db section found")
+	return entries, nil
+}
+
+func parseRdb(data []byte) (rdbData, error) {
+	result := rdbData{
+		aux:       map[string]string{},
+		databases: map[int]map[string]CacheItem{},
+	}
+
+	reader := &rdbReader{data: data}
+	header, err := reader.readBytes(9)
+	if err != nil {
+		return result, fmt.Errorf("error parsing rdb header: %w", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return result, fmt.Errorf("error parsing rdb header: bad magic %q", header[:5])
 	}
+	result.version, err = strconv.Atoi(string(header[5:]))
+	if err != nil || result.version < rdbMinVersion || result.version > rdbMaxVersion {
+		return result, fmt.Errorf("error parsing rdb header: unsupported version %q", header[5:])
+	}
+
+	db := 0
+	result.databases[db] = map[string]CacheItem{}
+	expiresAt := int64(-1)
+	for {
+		opcode, err := reader.readByte()
+		if err != nil {
+			return result, fmt.Errorf("error parsing rdb: %w", err)
+		}
+
+		switch opcode {
+		case rdbOpEof:
+			if err := verifyRdbChecksum(data, reader.pos, result.version); err != nil {
+				return result, err
+			}
+			result.size = reader.pos
+			if result.version >= 5 {
+				result.size += 8
+			}
+			return result, nil
+		case rdbOpAux:
+			key, err := reader.readString()
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb aux field: %w", err)
+			}
+			value, err := reader.readString()
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb aux field: %w", err)
+			}
+			result.aux[key] = value
+		case rdbOpSelectDb:
+			db, err = reader.readLength()
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb selectdb: %w", err)
+			}
+			if _, exists := result.databases[db]; !exists {
+				result.databases[db] = map[string]CacheItem{}
+			}
+		case rdbOpResizeDb:
+			if _, err := reader.readLength(); err != nil {
+				return result, fmt.Errorf("error parsing rdb resizedb: %w", err)
+			}
+			if _, err := reader.readLength(); err != nil {
+				return result, fmt.Errorf("error parsing rdb resizedb: %w", err)
+			}
+		case rdbOpExpireTimeMs:
+			expiresAt, err = reader.readMillisecondTime()
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb expiry: %w", err)
+			}
+		case rdbOpExpireTime:
+			raw, err := reader.readBytes(4)
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb expiry: %w", err)
+			}
+			expiresAt = int64(binary.LittleEndian.Uint32(raw)) * 1000
+		case rdbOpIdle:
+			if _, err := reader.readLength(); err != nil {
+				return result, fmt.Errorf("error parsing rdb idle time: %w", err)
+			}
+		case rdbOpFreq:
+			if _, err := reader.readByte(); err != nil {
+				return result, fmt.Errorf("error parsing rdb lfu frequency: %w", err)
+			}
+		case rdbOpModuleAux:
+			if _, err := reader.readUint64(); err != nil {
+				return result, fmt.Errorf("error parsing rdb module aux: %w", err)
+			}
+			if _, err := reader.readLength(); err != nil {
+				return result, fmt.Errorf("error parsing rdb module aux: %w", err)
+			}
+			if _, err := reader.readLength(); err != nil {
+				return result, fmt.Errorf("error parsing rdb module aux: %w", err)
+			}
+			if err := reader.skipModuleValue(); err != nil {
+				return result, fmt.Errorf("error parsing rdb module aux: %w", err)
+			}
+		case rdbOpFunction2:
+			if _, err := reader.readStringBytes(); err != nil {
+				return result, fmt.Errorf("error parsing rdb function: %w", err)
+			}
+		case rdbOpFunctionPreGa:
+			if err := reader.skipFunctionPreGa(); err != nil {
+				return result, fmt.Errorf("error parsing rdb function: %w", err)
+			}
+		default:
+			key, err := reader.readString()
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb key: %w", err)
+			}
+
+			item, err := reader.readValue(opcode)
+			if errors.Is(err, errRdbSkipValue) {
+				fmt.Printf("Skipping rdb key %s: module values are not supported\n", key)
+				expiresAt = -1
+				continue
+			}
+			if err != nil {
+				return result, fmt.Errorf("error parsing rdb value for key %s: %w", key, err)
+			}
 
-	keys := make(map[string]ValueInfo)
-	for idx := dbStartIdx + 5; idx < len(rdbFile) && rdbFile[idx] != 0xFF; {
-		expiry := int64(-1)
-		if rdbFile[idx] == 0xFC {
-			expiry = int64(binary.LittleEndian.Uint64(rdbFile[idx+1 : idx+9]))
-			idx += 9
+			item.expiresAt = expiresAt
+			result.databases[db][key] = item
+			expiresAt = -1
 		}
-		if rdbFile[idx] == 0xFD {
-			expiry = int64(binary.LittleEndian.Uint64(rdbFile[idx+1:idx+5])) * 1000
-			idx += 5
+	}
+}
+
+func (r *rdbReader) skipFunctionPreGa() error {
+	for i := 0; i < 2; i++ {
+		if _, err := r.readStringBytes(); err != nil {
+			return err
 		}
-		if rdbFile[idx] != 0x00 {
-			idx += 1
-			continue
+	}
+
+	hasDescription, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	if hasDescription != 0 {
+		if _, err := r.readStringBytes(); err != nil {
+			return err
 		}
-		idx += 1
+	}
+
+	_, err = r.readStringBytes()
+	return err
+}
+
+func verifyRdbChecksum(data []byte, eofEnd int, version int) error {
+	if version < 5 {
+		return nil
+	}
+	if eofEnd+8 > len(data) {
+		return fmt.Errorf("error parsing rdb: missing checksum")
+	}
+
+	expected := binary.LittleEndian.Uint64(data[eofEnd : eofEnd+8])
+	if expected == 0 {
+		return nil
+	}
+	if actual := updateRedisCrc64(0, data[:eofEnd]); actual != expected {
+		return fmt.Errorf("error parsing rdb: checksum mismatch (expected %x, got %x)", expected, actual)
+	}
 
-		key, n := decodeString(rdbFile, idx)
-		idx = n
+	return nil
+}
 
-		keys[key] = ValueInfo{position: n, expiresAt: expiry}
+func loadRdb(data []byte) error {
+	parsed, err := parseRdb(data)
+	if err != nil {
+		return err
 	}
 
-	return keys, nil
+	applyRdb(parsed)
+	return nil
 }
 
-func getValue(valueInfo ValueInfo) (string, error) {
-	if err := initRdbFile(); err != nil {
-		return "", fmt.Errorf("error getting value from rdb: %w", err)
+func applyRdb(parsed rdbData) {
+	now := time.Now().UnixMilli()
+	for db, items := range parsed.databases {
+		if db != 0 {
+			if len(items) > 0 {
+				fmt.Printf("Ignoring %d keys in rdb database %d, only database 0 is served\n", len(items), db)
+			}
+			continue
+		}
+
+		for key, item := range items {
+			if isExpired(item, now) {
+				continue
+			}
+			keyspace.Set(key, item)
+		}
 	}
+}
 
-	rdbMutex.Lock()
-	defer rdbMutex.Unlock()
+func loadRdbFile() error {
+	path := rdbPath()
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No rdb file at %s, starting empty\n", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error loading rdb file: %w", err)
+	}
 
-	value, _ := decodeString(rdbFile, valueInfo.position)
+	if err := loadRdb(contents); err != nil {
+		return fmt.Errorf("error loading rdb file: %w", err)
+	}
 
-	return value, nil
+	return nil
 }
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"strconv"
+)
+
+// Redis uses the reflected CRC-64/Jones polynomial with no pre or post
+// inversion, whereas hash/crc64 inverts on the way in and out.
+var crc64JonesTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+func updateRedisCrc64(crc uint64, data []byte) uint64 {
+	return ^crc64.Update(^crc, crc64JonesTable, data)
+}
+
+func lzfDecompress(in []byte, expectedLength int) ([]byte, error) {
+	out := make([]byte, 0, expectedLength)
+
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 32 {
+			length := ctrl + 1
+			if ip+length > len(in) {
+				return nil, fmt.Errorf("error decompressing lzf: literal run past end of input")
+			}
+			out = append(out, in[ip:ip+length]...)
+			ip += length
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, fmt.Errorf("error decompressing lzf: truncated back reference")
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, fmt.Errorf("error decompressing lzf: truncated back reference")
+		}
+
+		ref := len(out) - ((ctrl & 0x1F) << 8) - int(in[ip]) - 1
+		ip++
+		if ref < 0 {
+			return nil, fmt.Errorf("error decompressing lzf: back reference before start of output")
+		}
+
+		for i := 0; i < length+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != expectedLength {
+		return nil, fmt.Errorf("error decompressing lzf: expected %d bytes, got %d", expectedLength, len(out))
+	}
+
+	return out, nil
+}
+
+func signExtend(value uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(value<<shift) >> shift
+}
+
+func parseZiplist(raw []byte) ([]string, error) {
+	if len(raw) < 11 {
+		return nil, fmt.Errorf("error parsing ziplist: too short")
+	}
+
+	entries := []string{}
+	reader := &rdbReader{data: raw, pos: 10}
+	for {
+		prevLen, err := reader.readByte()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ziplist: %w", err)
+		}
+		if prevLen == 0xFF {
+			return entries, nil
+		}
+		if prevLen == 0xFE {
+			if _, err := reader.readBytes(4); err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+		}
+
+		encoding, err := reader.readByte()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ziplist: %w", err)
+		}
+
+		var entry string
+		switch {
+		case encoding>>6 == 0:
+			raw, err := reader.readBytes(int(encoding & 0x3F))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+			entry = string(raw)
+		case encoding>>6 == 1:
+			next, err := reader.readByte()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+			raw, err := reader.readBytes(int(encoding&0x3F)<<8 | int(next))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+			entry = string(raw)
+		case encoding == 0x80:
+			lengthRaw, err := reader.readBytes(4)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+			raw, err := reader.readBytes(int(binary.BigEndian.Uint32(lengthRaw)))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+			entry = string(raw)
+		default:
+			value, err := readZiplistInt(reader, encoding)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ziplist: %w", err)
+			}
+			entry = strconv.FormatInt(value, 10)
+		}
+
+		entries = append(entries, entry)
+	}
+}
+
+func readZiplistInt(reader *rdbReader, encoding byte) (int64, error) {
+	size := 0
+	switch encoding {
+	case 0xC0:
+		size = 2
+	case 0xD0:
+		size = 4
+	case 0xE0:
+		size = 8
+	case 0xF0:
+		size = 3
+	case 0xFE:
+		size = 1
+	default:
+		if encoding >= 0xF1 && encoding <= 0xFD {
+			return int64(encoding&0x0F) - 1, nil
+		}
+		return 0, fmt.Errorf("unknown ziplist encoding 0x%x", encoding)
+	}
+
+	raw, err := reader.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var value uint64
+	for i := size - 1; i >= 0; i-- {
+		value = value<<8 | uint64(raw[i])
+	}
+
+	return signExtend(value, uint(size*8)), nil
+}
+
+func parseListpack(raw []byte) ([]string, error) {
+	if len(raw) < 7 {
+		return nil, fmt.Errorf("error parsing listpack: too short")
+	}
+
+	entries := []string{}
+	reader := &rdbReader{data: raw, pos: 6}
+	for {
+		start := reader.pos
+		encoding, err := reader.readByte()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing listpack: %w", err)
+		}
+		if encoding == 0xFF {
+			return entries, nil
+		}
+
+		var entry string
+		switch {
+		case encoding>>7 == 0:
+			entry = strconv.Itoa(int(encoding & 0x7F))
+		case encoding>>6 == 2:
+			raw, err := reader.readBytes(int(encoding & 0x3F))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			entry = string(raw)
+		case encoding>>5 == 6:
+			next, err := reader.readByte()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			value := uint64(encoding&0x1F)<<8 | uint64(next)
+			entry = strconv.FormatInt(signExtend(value, 13), 10)
+		case encoding>>4 == 14:
+			next, err := reader.readByte()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			raw, err := reader.readBytes(int(encoding&0x0F)<<8 | int(next))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			entry = string(raw)
+		case encoding == 0xF0:
+			lengthRaw, err := reader.readBytes(4)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			raw, err := reader.readBytes(int(binary.LittleEndian.Uint32(lengthRaw)))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			entry = string(raw)
+		case encoding >= 0xF1 && encoding <= 0xF4:
+			size := []int{2, 3, 4, 8}[encoding-0xF1]
+			raw, err := reader.readBytes(size)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listpack: %w", err)
+			}
+			var value uint64
+			for i := size - 1; i >= 0; i-- {
+				value = value<<8 | uint64(raw[i])
+			}
+			entry = strconv.FormatInt(signExtend(value, uint(size*8)), 10)
+		default:
+			return nil, fmt.Errorf("error parsing listpack: unknown encoding 0x%x", encoding)
+		}
+
+		if _, err := reader.readBytes(listpackBacklenSize(reader.pos - start)); err != nil {
+			return nil, fmt.Errorf("error parsing listpack: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func listpackBacklenSize(entrySize int) int {
+	switch {
+	case entrySize <= 127:
+		return 1
+	case entrySize < 16383:
+		return 2
+	case entrySize < 2097151:
+		return 3
+	case entrySize < 268435455:
+		return 4
+	}
+
+	return 5
+}
+
+func parseIntset(raw []byte) ([]string, error) {
+	if len(raw) < 8 {
+		return nil, fmt.Errorf("error parsing intset: too short")
+	}
+
+	size := int(binary.LittleEndian.Uint32(raw[0:4]))
+	length := int(binary.LittleEndian.Uint32(raw[4:8]))
+	if size != 2 && size != 4 && size != 8 {
+		return nil, fmt.Errorf("error parsing intset: invalid encoding %d", size)
+	}
+	if 8+size*length > len(raw) {
+		return nil, fmt.Errorf("error parsing intset: contents past end of blob")
+	}
+
+	members := make([]string, 0, length)
+	for i := 0; i < length; i++ {
+		raw := raw[8+i*size : 8+(i+1)*size]
+		var value int64
+		switch size {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(raw)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(raw)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(raw))
+		}
+		members = append(members, strconv.FormatInt(value, 10))
+	}
+
+	return members, nil
+}
+
+func parseZipmap(raw []byte) (map[string]string, error) {
+	hash := map[string]string{}
+	reader := &rdbReader{data: raw, pos: 1}
+
+	readZipmapLength := func() (int, bool, error) {
+		first, err := reader.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		if first == 0xFF {
+			return 0, true, nil
+		}
+		if first < 254 {
+			return int(first), false, nil
+		}
+		raw, err := reader.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return int(binary.LittleEndian.Uint32(raw)), false, nil
+	}
+
+	for {
+		keyLength, end, err := readZipmapLength()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing zipmap: %w", err)
+		}
+		if end {
+			return hash, nil
+		}
+		key, err := reader.readBytes(keyLength)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing zipmap: %w", err)
+		}
+
+		valueLength, _, err := readZipmapLength()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing zipmap: %w", err)
+		}
+		free, err := reader.readByte()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing zipmap: %w", err)
+		}
+		value, err := reader.readBytes(valueLength)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing zipmap: %w", err)
+		}
+		if _, err := reader.readBytes(int(free)); err != nil {
+			return nil, fmt.Errorf("error parsing zipmap: %w", err)
+		}
+
+		hash[string(key)] = string(value)
+	}
+}
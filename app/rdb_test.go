@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, parts ...string) []byte {
+	t.Helper()
+
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		t.Fatalf("invalid hex in test data: %v", err)
+	}
+	return raw
+}
+
+// A dump laid out byte for byte the way redis-server 7.2 saves these values:
+// small collections as listpacks or intsets, integer-like strings in their
+// int encodings and long repetitive strings LZF compressed.
+var redis72Dump = []string{
+	"524544495330303131",                           // REDIS0011
+	"fa0972656469732d76657205372e322e34",           // aux redis-ver 7.2.4
+	"fa0a72656469732d62697473c040",                 // aux redis-bits 64
+	"fa056374696d65c200f15365",                     // aux ctime 1700000000
+	"fa08757365642d6d656dc2907c1100",               // aux used-mem 1146000
+	"fa08616f662d62617365c000",                     // aux aof-base 0
+	"fe00",                                         // selectdb 0
+	"fb0b01",                                       // resizedb 11 1
+	"00086772656574696e670568656c6c6f",             // greeting = hello
+	"0005736d616c6cc0fb",                           // small = -5 as int8
+	"00066d656469756dc1e803",                       // medium = 1000 as int16
+	"00056c61726765c2a0860100",                     // large = 100000 as int32
+	"000a636f6d70726573736564c3071e02616263e01202", // compressed = "abc" x10 as LZF
+	"fc00d8c32cbb030000000773657373696f6e0178",     // session = x, expiring 2100-01-01
+	"12046c697374010216160000000400836f6e65048374776f040301c3e802ff",                       // list = [one two 3 1000] as a quicklist
+	"0b076e756d626572730e0200000003000000fdff01000200",                                     // numbers = {-3 1 2} as an intset
+	"140666727569747316160000000200856170706c65068662616e616e6107ff",                       // fruits = {apple banana} as a listpack
+	"1004757365721b1b0000000400846e616d65058572656469730683616765040c01ff",                 // user = {name: redis, age: 12}
+	"110673636f72657314140000000400816102010181620283322e3504ff",                           // scores = {a: 1, b: 2.5}
+	"150673656e736f7201100000018bcfe568000000000000000000",                                 // sensor, one listpack from 1700000000000-0
+	"29290000000f000201000101018474656d700500010201000100011501040102010101000116010401ff", // {temp: 21}, {temp: 22}
+	"02810000018bcfe5680100810000018bcfe5680000000002",                                     // length, last id, first id, max deleted, added
+	"010167810000018bcfe568010002000105616c6963650568e5cf8b0100000568e5cf8b01000000",       // group g, consumer alice
+	"ff",               // EOF
+	"9ffca5f2f0c21647", // CRC64
+}
+
+func TestParseRdbRedisDump(t *testing.T) {
+	parsed, err := parseRdb(mustDecodeHex(t, redis72Dump...))
+	if err != nil {
+		t.Fatalf("parseRdb: %v", err)
+	}
+
+	if parsed.version != 11 {
+		t.Errorf("version = %d, want 11", parsed.version)
+	}
+	wantAux := map[string]string{
+		"redis-ver":  "7.2.4",
+		"redis-bits": "64",
+		"ctime":      "1700000000",
+		"used-mem":   "1146000",
+		"aof-base":   "0",
+	}
+	if !reflect.DeepEqual(parsed.aux, wantAux) {
+		t.Errorf("aux = %v, want %v", parsed.aux, wantAux)
+	}
+
+	str := func(value string) CacheItem {
+		return CacheItem{itemType: "string", value: value, expiresAt: -1}
+	}
+	want := map[string]CacheItem{
+		"greeting":   str("hello"),
+		"small":      str("-5"),
+		"medium":     str("1000"),
+		"large":      str("100000"),
+		"compressed": str(strings.Repeat("abc", 10)),
+		"session":    {itemType: "string", value: "x", expiresAt: 4102444800000},
+		"list":       {itemType: "list", list: []string{"one", "two", "3", "1000"}, expiresAt: -1},
+		"numbers":    {itemType: "set", set: toSet([]string{"-3", "1", "2"}), expiresAt: -1},
+		"fruits":     {itemType: "set", set: toSet([]string{"apple", "banana"}), expiresAt: -1},
+		"user":       {itemType: "hash", hash: map[string]string{"name": "redis", "age": "12"}, expiresAt: -1},
+		"scores":     {itemType: "zset", zset: map[string]float64{"a": 1, "b": 2.5}, expiresAt: -1},
+		"sensor": {itemType: "stream", expiresAt: -1, stream: &Stream{
+			lastMillisecondsTime: 1700000000001,
+			entries: []StreamEntry{
+				{timestamp: 1700000000000, values: map[string]string{"temp": "21"}},
+				{timestamp: 1700000000001, values: map[string]string{"temp": "22"}},
+			},
+		}},
+	}
+
+	items := parsed.databases[0]
+	if len(items) != len(want) {
+		t.Errorf("got %d keys, want %d", len(items), len(want))
+	}
+	for key, wantItem := range want {
+		if item := items[key]; !reflect.DeepEqual(item, wantItem) {
+			t.Errorf("%s = %+v, want %+v", key, item, wantItem)
+		}
+	}
+}
+
+func TestParseRdbErrors(t *testing.T) {
+	dump := mustDecodeHex(t, redis72Dump...)
+	withByte := func(pos int, b byte) []byte {
+		corrupted := bytes.Clone(dump)
+		corrupted[pos] = b
+		return corrupted
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "error parsing rdb header"},
+		{"bad magic", append([]byte("RADIS0011"), dump[9:]...), "bad magic"},
+		{"future version", append([]byte("REDIS0012"), dump[9:]...), "unsupported version"},
+		{"truncated", dump[:len(dump)/2], "unexpected end of rdb"},
+		{"missing checksum", dump[:len(dump)-8], "missing checksum"},
+		{"checksum mismatch", withByte(len(dump)-1, dump[len(dump)-1]^1), "checksum mismatch"},
+		{"corrupted value", withByte(bytes.Index(dump, []byte("hello")), 'j'), "checksum mismatch"},
+		{"unknown type", mustDecodeHex(t, "524544495330303033", "1e016b0176", "ff"), "unknown value type 30"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRdb(test.data)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("parseRdb error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRdbZeroChecksum(t *testing.T) {
+	dump := mustDecodeHex(t, redis72Dump...)
+	copy(dump[len(dump)-8:], make([]byte, 8))
+
+	if _, err := parseRdb(dump); err != nil {
+		t.Errorf("parseRdb with checksum disabled: %v", err)
+	}
+}
+
+func TestEncodeRdbRoundTrip(t *testing.T) {
+	items := map[string]CacheItem{
+		"string":   {itemType: "string", value: "value", expiresAt: -1},
+		"empty":    {itemType: "string", value: "", expiresAt: -1},
+		"binary":   {itemType: "string", value: "a\r\n\x00\xff", expiresAt: -1},
+		"long":     {itemType: "string", value: strings.Repeat("x", 20000), expiresAt: -1},
+		"expiring": {itemType: "string", value: "soon", expiresAt: 1700000000123},
+		"list":     {itemType: "list", list: []string{"a", "b", "a"}, expiresAt: -1},
+		"set":      {itemType: "set", set: toSet([]string{"x", "y"}), expiresAt: -1},
+		"zset":     {itemType: "zset", zset: map[string]float64{"low": -1.5, "high": 1e100}, expiresAt: -1},
+		"hash":     {itemType: "hash", hash: map[string]string{"field": "value", "n": "1"}, expiresAt: -1},
+		"stream": {itemType: "stream", expiresAt: -1, stream: &Stream{
+			lastMillisecondsTime: 1700000009999,
+			lastSequenceNumber:   7,
+			entries: []StreamEntry{
+				{timestamp: 1700000000000, sequenceNumber: 0, values: map[string]string{"a": "1"}},
+				{timestamp: 1700000000000, sequenceNumber: 1, values: map[string]string{"a": "2", "b": strings.Repeat("y", 100)}},
+				{timestamp: 1700000009999, sequenceNumber: 7, values: map[string]string{"big": "-100000", "neg": "-5"}},
+			},
+		}},
+		"empty stream": {itemType: "stream", expiresAt: -1, stream: &Stream{lastMillisecondsTime: 5, lastSequenceNumber: 1}},
+	}
+
+	var buf bytes.Buffer
+	if err := encodeRdb(&buf, items); err != nil {
+		t.Fatalf("encodeRdb: %v", err)
+	}
+
+	parsed, err := parseRdb(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parseRdb: %v", err)
+	}
+	if parsed.size != buf.Len() {
+		t.Errorf("size = %d, want %d", parsed.size, buf.Len())
+	}
+	if parsed.aux["redis-ver"] == "" {
+		t.Errorf("aux fields missing: %v", parsed.aux)
+	}
+	if !reflect.DeepEqual(parsed.databases[0], items) {
+		t.Errorf("round trip mismatch\ngot:  %+v\nwant: %+v", parsed.databases[0], items)
+	}
+}
+
+func TestRedisCrc64(t *testing.T) {
+	// The check value from Redis' own crc64 self test.
+	if crc := updateRedisCrc64(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64 = %x, want e9c6d914c4b8d9ca", crc)
+	}
+
+	// Checksumming in pieces, as the rdb writer does, gives the same result.
+	crc := updateRedisCrc64(updateRedisCrc64(0, []byte("1234")), []byte("56789"))
+	if crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("incremental crc64 = %x, want e9c6d914c4b8d9ca", crc)
+	}
+}
+
+func TestLzfDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		length  int
+		want    string
+		wantErr string
+	}{
+		{"literal run", "046162636465", 5, "abcde", ""},
+		{"back reference", "0561626364656640" + "03", 10, "abcdefcdef", ""},
+		{"overlapping back reference", "02616263e01202", 30, strings.Repeat("abc", 10), ""},
+		{"shortest back reference", "0161622001", 5, "ababa", ""},
+		{"truncated literal", "05616263", 6, "", "literal run past end of input"},
+		{"truncated long back reference", "0061e0", 10, "", "truncated back reference"},
+		{"truncated back reference", "006120", 10, "", "truncated back reference"},
+		{"reference before start", "01616220ff", 10, "", "back reference before start of output"},
+		{"wrong length", "0061", 3, "", "expected 3 bytes, got 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := lzfDecompress(mustDecodeHex(t, test.in), test.length)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lzfDecompress: %v", err)
+			}
+			if string(out) != test.want {
+				t.Errorf("lzfDecompress = %q, want %q", out, test.want)
+			}
+		})
+	}
+}
+
+// Builds a ziplist from entries given as their encoding header and data,
+// filling in the list header and each entry's prevlen.
+func buildZiplist(entries ...[]byte) []byte {
+	raw := make([]byte, 10)
+	prevLen := 0
+	tail := 10
+	for _, entry := range entries {
+		tail = len(raw)
+		if prevLen < 254 {
+			raw = append(raw, byte(prevLen))
+			prevLen = 1 + len(entry)
+		} else {
+			raw = append(raw, 0xFE)
+			raw = binary.LittleEndian.AppendUint32(raw, uint32(prevLen))
+			prevLen = 5 + len(entry)
+		}
+		raw = append(raw, entry...)
+	}
+	raw = append(raw, 0xFF)
+
+	binary.LittleEndian.PutUint32(raw[0:4], uint32(len(raw)))
+	binary.LittleEndian.PutUint32(raw[4:8], uint32(tail))
+	binary.LittleEndian.PutUint16(raw[8:10], uint16(len(entries)))
+	return raw
+}
+
+func TestParseZiplist(t *testing.T) {
+	long := strings.Repeat("z", 300)
+	huge := strings.Repeat("h", 20000)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    []string
+		wantErr string
+	}{
+		{"empty", buildZiplist(), []string{}, ""},
+		{"short strings", buildZiplist([]byte("\x03foo"), []byte("\x00")), []string{"foo", ""}, ""},
+		{"14 bit string and long prevlen", buildZiplist(append([]byte{0x41, 0x2C}, long...), []byte("\x01x")), []string{long, "x"}, ""},
+		{"32 bit string", buildZiplist(append([]byte{0x80, 0x00, 0x00, 0x4E, 0x20}, huge...)), []string{huge}, ""},
+		{"immediate ints", buildZiplist([]byte{0xF1}, []byte{0xFD}), []string{"0", "12"}, ""},
+		{"int8", buildZiplist([]byte{0xFE, 0x80}), []string{"-128"}, ""},
+		{"int16", buildZiplist([]byte{0xC0, 0x18, 0xFC}), []string{"-1000"}, ""},
+		{"int24", buildZiplist([]byte{0xF0, 0x40, 0x42, 0x0F}), []string{"1000000"}, ""},
+		{"int32", buildZiplist([]byte{0xD0, 0x00, 0x00, 0x00, 0x80}), []string{"-2147483648"}, ""},
+		{"int64", buildZiplist([]byte{0xE0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}), []string{"9223372036854775807"}, ""},
+		{"too short", []byte{0x0B, 0, 0, 0}, nil, "too short"},
+		{"unknown encoding", buildZiplist([]byte{0xC1}), nil, "unknown ziplist encoding 0xc1"},
+		{"truncated string", buildZiplist([]byte("\x05ab"))[:14], nil, "unexpected end"},
+		{"missing end", buildZiplist([]byte("\x01a"))[:13], nil, "unexpected end"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseZiplist(test.raw)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseZiplist: %v", err)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("parseZiplist = %q, want %q", entries, test.want)
+			}
+		})
+	}
+}
+
+// Builds a listpack from entries given as their encoding header and data,
+// adding each entry's backlen and the list header.
+func buildListpack(entries ...[]byte) []byte {
+	body := []byte{}
+	for _, entry := range entries {
+		body = append(body, entry...)
+		body = append(body, listpackBacklen(len(entry))...)
+	}
+
+	raw := binary.LittleEndian.AppendUint32(nil, uint32(6+len(body)+1))
+	raw = binary.LittleEndian.AppendUint16(raw, uint16(len(entries)))
+	raw = append(raw, body...)
+	return append(raw, 0xFF)
+}
+
+func TestParseListpack(t *testing.T) {
+	medium := strings.Repeat("m", 200)
+	huge := strings.Repeat("h", 5000)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    []string
+		wantErr string
+	}{
+		{"empty", buildListpack(), []string{}, ""},
+		{"7 bit uints", buildListpack([]byte{0x00}, []byte{0x7F}), []string{"0", "127"}, ""},
+		{"6 bit strings", buildListpack([]byte("\x83abc"), []byte{0x80}), []string{"abc", ""}, ""},
+		{"13 bit ints", buildListpack([]byte{0xC3, 0xE8}, []byte{0xDF, 0xFF}, []byte{0xD0, 0x00}), []string{"1000", "-1", "-4096"}, ""},
+		{"12 bit string", buildListpack(append([]byte{0xE0, 0xC8}, medium...)), []string{medium}, ""},
+		{"32 bit string", buildListpack(append([]byte{0xF0, 0x88, 0x13, 0x00, 0x00}, huge...)), []string{huge}, ""},
+		{"int16", buildListpack([]byte{0xF1, 0x00, 0x80}), []string{"-32768"}, ""},
+		{"int24", buildListpack([]byte{0xF2, 0xFF, 0xFF, 0x7F}), []string{"8388607"}, ""},
+		{"int32", buildListpack([]byte{0xF3, 0xFF, 0xFF, 0xFF, 0xFF}), []string{"-1"}, ""},
+		{"int64", buildListpack([]byte{0xF4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80}), []string{"-9223372036854775808"}, ""},
+		{"too short", []byte{0x07, 0, 0, 0, 0, 0}, nil, "too short"},
+		{"unknown encoding", buildListpack([]byte{0xF5}), nil, "unknown encoding 0xf5"},
+		{"truncated string", buildListpack([]byte("\x85ab"))[:9], nil, "unexpected end"},
+		{"missing end", buildListpack([]byte{0x01})[:8], nil, "unexpected end"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseListpack(test.raw)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseListpack: %v", err)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("parseListpack = %q, want %q", entries, test.want)
+			}
+		})
+	}
+}
+
+func TestParseIntset(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []string
+		wantErr string
+	}{
+		{"int16", "02000000" + "02000000" + "00800100", []string{"-32768", "1"}, ""},
+		{"int32", "04000000" + "01000000" + "00000080", []string{"-2147483648"}, ""},
+		{"int64", "08000000" + "01000000" + "ffffffffffffff7f", []string{"9223372036854775807"}, ""},
+		{"empty", "02000000" + "00000000", []string{}, ""},
+		{"too short", "020000000000", nil, "too short"},
+		{"invalid encoding", "03000000" + "00000000", nil, "invalid encoding 3"},
+		{"truncated", "04000000" + "02000000" + "01000000", nil, "past end of blob"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			members, err := parseIntset(mustDecodeHex(t, test.raw))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIntset: %v", err)
+			}
+			if !reflect.DeepEqual(members, test.want) {
+				t.Errorf("parseIntset = %q, want %q", members, test.want)
+			}
+		})
+	}
+}
+
+func TestParseZipmap(t *testing.T) {
+	long := strings.Repeat("v", 300)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    map[string]string
+		wantErr string
+	}{
+		{"empty", []byte{0x00, 0xFF}, map[string]string{}, ""},
+		{"pairs", []byte("\x02\x03foo\x03\x00bar\x01a\x00\x00\xff"), map[string]string{"foo": "bar", "a": ""}, ""},
+		{"free space", []byte("\x01\x01k\x01\x02vxx\xff"), map[string]string{"k": "v"}, ""},
+		{"long value", append(append([]byte("\x01\x01k\xfe\x2c\x01\x00\x00\x00"), long...), 0xFF), map[string]string{"k": long}, ""},
+		{"truncated key", []byte("\x01\x05ab"), nil, "unexpected end"},
+		{"missing end", []byte("\x01\x01k\x01\x00v"), nil, "unexpected end"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hash, err := parseZipmap(test.raw)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseZipmap: %v", err)
+			}
+			if !reflect.DeepEqual(hash, test.want) {
+				t.Errorf("parseZipmap = %q, want %q", hash, test.want)
+			}
+		})
+	}
+}
+
+func TestParseStreamListpack(t *testing.T) {
+	tests := []struct {
+		name    string
+		lp      []string
+		want    []StreamEntry
+		wantErr string
+	}{
+		{
+			name: "master fields and own fields",
+			lp: []string{
+				"3", "1", "1", "f", "0",
+				"2", "0", "0", "a", "4",
+				"0", "5", "1", "2", "x", "1", "y", "2", "7",
+				"3", "6", "0", "c", "4",
+			},
+			want: []StreamEntry{
+				{timestamp: 100, sequenceNumber: 7, values: map[string]string{"f": "a"}},
+				{timestamp: 105, sequenceNumber: 8, values: map[string]string{"x": "1", "y": "2"}},
+			},
+		},
+		{name: "missing master entry", lp: []string{"1", "0"}, wantErr: "missing master entry"},
+		{name: "truncated master entry", lp: []string{"1", "0", "2", "f"}, wantErr: "master entry truncated"},
+		{name: "truncated entry", lp: []string{"1", "0", "0", "0", "0", "0", "0", "3", "a"}, wantErr: "entry truncated"},
+		{name: "not an integer", lp: []string{"1", "0", "zero", "0"}, wantErr: "invalid stream listpack integer"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseStreamListpack(test.lp, 100, 7)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStreamListpack: %v", err)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("parseStreamListpack = %+v, want %+v", entries, test.want)
+			}
+		})
+	}
+}
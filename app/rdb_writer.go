@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rdbWriteVersion = "0011"
+
+var saveLock = sync.Mutex{}
+var bgsaveInProgress = false
+var lastSaveTime = time.Now().Unix()
+var lastBgsaveTry = int64(0)
+var lastBgsaveOk = true
+
+var errBgsaveInProgress = fmt.Errorf("background save already in progress")
+
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (r *rdbWriter) write(p []byte) {
+	if r.err != nil {
+		return
+	}
+
+	r.crc = updateRedisCrc64(r.crc, p)
+	_, r.err = r.w.Write(p)
+}
+
+func (r *rdbWriter) writeByte(b byte) {
+	r.write([]byte{b})
+}
+
+func (r *rdbWriter) writeLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		r.writeByte(byte(length))
+	case length < 1<<14:
+		r.write([]byte{byte(length>>8) | 0x40, byte(length)})
+	case length <= math.MaxUint32:
+		raw := make([]byte, 5)
+		raw[0] = 0x80
+		binary.BigEndian.PutUint32(raw[1:], uint32(length))
+		r.write(raw)
+	default:
+		raw := make([]byte, 9)
+		raw[0] = 0x81
+		binary.BigEndian.PutUint64(raw[1:], length)
+		r.write(raw)
+	}
+}
+
+func (r *rdbWriter) writeString(str string) {
+	r.writeLength(uint64(len(str)))
+	r.write([]byte(str))
+}
+
+func (r *rdbWriter) writeMillisecondTime(ms int64) {
+	raw := make([]byte, 8)
+	binary.LittleEndian.PutUint64(raw, uint64(ms))
+	r.write(raw)
+}
+
+func (r *rdbWriter) writeBinaryDouble(value float64) {
+	raw := make([]byte, 8)
+	binary.LittleEndian.PutUint64(raw, math.Float64bits(value))
+	r.write(raw)
+}
+
+func rdbValueType(item CacheItem) byte {
+	switch item.itemType {
+	case "list":
+		return rdbTypeList
+	case "set":
+		return rdbTypeSet
+	case "zset":
+		return rdbTypeZset2
+	case "hash":
+		return rdbTypeHash
+	case "stream":
+		return rdbTypeStreamListpacks
+	}
+
+	return rdbTypeString
+}
+
+func (r *rdbWriter) writeValue(item CacheItem) {
+	switch item.itemType {
+	case "string":
+		r.writeString(item.value)
+	case "list":
+		r.writeLength(uint64(len(item.list)))
+		for _, value := range item.list {
+			r.writeString(value)
+		}
+	case "set":
+		r.writeLength(uint64(len(item.set)))
+		for member := range item.set {
+			r.writeString(member)
+		}
+	case "zset":
+		r.writeLength(uint64(len(item.zset)))
+		for member, score := range item.zset {
+			r.writeString(member)
+			r.writeBinaryDouble(score)
+		}
+	case "hash":
+		r.writeLength(uint64(len(item.hash)))
+		for field, value := range item.hash {
+			r.writeString(field)
+			r.writeString(value)
+		}
+	case "stream":
+		r.writeStream(item.stream)
+	default:
+		r.err = fmt.Errorf("cannot serialize value of type %s", item.itemType)
+	}
+}
+
+// Streams are written as a single listpack whose master entry has no fields,
+// so every entry carries its own field names.
+func (r *rdbWriter) writeStream(stream *Stream) {
+	if len(stream.entries) == 0 {
+		r.writeLength(0)
+	} else {
+		first := stream.entries[0]
+		masterId := make([]byte, 16)
+		binary.BigEndian.PutUint64(masterId[:8], uint64(first.timestamp))
+		binary.BigEndian.PutUint64(masterId[8:], uint64(first.sequenceNumber))
+
+		lp := &listpackBuilder{}
+		lp.appendInt(int64(len(stream.entries)))
+		lp.appendInt(0)
+		lp.appendInt(0)
+		lp.appendInt(0)
+		for _, entry := range stream.entries {
+			lp.appendInt(0)
+			lp.appendInt(entry.timestamp - first.timestamp)
+			lp.appendInt(int64(entry.sequenceNumber - first.sequenceNumber))
+			lp.appendInt(int64(len(entry.values)))
+			for _, field := range sortedKeys(entry.values) {
+				lp.appendString(field)
+				lp.appendString(entry.values[field])
+			}
+			lp.appendInt(int64(4 + 2*len(entry.values)))
+		}
+
+		r.writeLength(1)
+		r.writeString(string(masterId))
+		r.writeString(string(lp.bytes()))
+	}
+
+	r.writeLength(uint64(len(stream.entries)))
+	r.writeLength(uint64(stream.lastMillisecondsTime))
+	r.writeLength(uint64(stream.lastSequenceNumber))
+	r.writeLength(0)
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+type listpackBuilder struct {
+	entries  []byte
+	numItems int
+}
+
+func (lp *listpackBuilder) appendEntry(encoded []byte) {
+	lp.entries = append(lp.entries, encoded...)
+	lp.entries = append(lp.entries, listpackBacklen(len(encoded))...)
+	lp.numItems++
+}
+
+func (lp *listpackBuilder) appendInt(value int64) {
+	switch {
+	case value >= 0 && value <= 127:
+		lp.appendEntry([]byte{byte(value)})
+	case value >= -4096 && value <= 4095:
+		lp.appendEntry([]byte{0xC0 | byte((uint64(value)>>8)&0x1F), byte(value)})
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		lp.appendEntry([]byte{0xF1, byte(value), byte(value >> 8)})
+	case value >= -(1<<23) && value < 1<<23:
+		lp.appendEntry([]byte{0xF2, byte(value), byte(value >> 8), byte(value >> 16)})
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		raw := []byte{0xF3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(raw[1:], uint32(value))
+		lp.appendEntry(raw)
+	default:
+		raw := []byte{0xF4, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(raw[1:], uint64(value))
+		lp.appendEntry(raw)
+	}
+}
+
+func (lp *listpackBuilder) appendString(str string) {
+	var header []byte
+	switch {
+	case len(str) < 64:
+		header = []byte{0x80 | byte(len(str))}
+	case len(str) < 4096:
+		header = []byte{0xE0 | byte(len(str)>>8), byte(len(str))}
+	default:
+		header = []byte{0xF0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(header[1:], uint32(len(str)))
+	}
+
+	lp.appendEntry(append(header, str...))
+}
+
+func (lp *listpackBuilder) bytes() []byte {
+	raw := make([]byte, 6, 6+len(lp.entries)+1)
+	binary.LittleEndian.PutUint32(raw[0:4], uint32(6+len(lp.entries)+1))
+	numItems := lp.numItems
+	if numItems > math.MaxUint16 {
+		numItems = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(raw[4:6], uint16(numItems))
+
+	raw = append(raw, lp.entries...)
+	return append(raw, 0xFF)
+}
+
+func listpackBacklen(size int) []byte {
+	backlen := []byte{}
+	for i := listpackBacklenSize(size) - 1; i >= 0; i-- {
+		part := byte(size>>(7*i)) & 0x7F
+		if i != listpackBacklenSize(size)-1 {
+			part |= 0x80
+		}
+		backlen = append(backlen, part)
+	}
+
+	return backlen
+}
+
+func encodeRdb(w io.Writer, items map[string]CacheItem) error {
+	writer := &rdbWriter{w: bufio.NewWriter(w)}
+
+	writer.write([]byte("REDIS" + rdbWriteVersion))
+	for _, aux := range [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	} {
+		writer.writeByte(rdbOpAux)
+		writer.writeString(aux[0])
+		writer.writeString(aux[1])
+	}
+
+	numExpires := 0
+	for _, item := range items {
+		if item.expiresAt != -1 {
+			numExpires++
+		}
+	}
+
+	writer.writeByte(rdbOpSelectDb)
+	writer.writeLength(0)
+	writer.writeByte(rdbOpResizeDb)
+	writer.writeLength(uint64(len(items)))
+	writer.writeLength(uint64(numExpires))
+
+	for key, item := range items {
+		if item.expiresAt != -1 {
+			writer.writeByte(rdbOpExpireTimeMs)
+			writer.writeMillisecondTime(item.expiresAt)
+		}
+		writer.writeByte(rdbValueType(item))
+		writer.writeString(key)
+		writer.writeValue(item)
+	}
+
+	writer.writeByte(rdbOpEof)
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, writer.crc)
+	writer.write(checksum)
+
+	if writer.err != nil {
+		return fmt.Errorf("error encoding rdb: %w", writer.err)
+	}
+	if err := writer.w.Flush(); err != nil {
+		return fmt.Errorf("error encoding rdb: %w", err)
+	}
+
+	return nil
+}
+
+func rdbPath() string {
+	dir := getConfig("dir")
+	if dir == "" {
+		dir = "."
+	}
+	dbfilename := getConfig("dbfilename")
+	if dbfilename == "" {
+		dbfilename = "dump.rdb"
+	}
+
+	return filepath.Join(dir, dbfilename)
+}
+
+// The snapshot is written to a temp file in the same directory and renamed
+// over the old dump, so a crash mid-write never leaves a truncated file behind.
+func writeRdbFile(items map[string]CacheItem) error {
+	path := rdbPath()
+	tempPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("error creating temp rdb file: %w", err)
+	}
+
+	if err := encodeRdb(file, items); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("error syncing temp rdb file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("error closing temp rdb file: %w", err)
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("error renaming temp rdb file: %w", err)
+	}
+
+	return nil
+}
+
+func saveRdb() error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	if bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+
+	dirtyBeforeSave := dirty.Load()
+	if err := writeRdbFile(keyspace.Snapshot()); err != nil {
+		return err
+	}
+
+	dirty.Add(-dirtyBeforeSave)
+	lastSaveTime = time.Now().Unix()
+	return nil
+}
+
+func startBgsave() error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	if bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	bgsaveInProgress = true
+	lastBgsaveTry = time.Now().Unix()
+
+	dirtyBeforeSave := dirty.Load()
+	items := keyspace.Snapshot()
+	go func() {
+		err := writeRdbFile(items)
+
+		saveLock.Lock()
+		defer saveLock.Unlock()
+
+		bgsaveInProgress = false
+		lastBgsaveOk = err == nil
+		if err != nil {
+			fmt.Println("Background save failed:", err.Error())
+			return
+		}
+		dirty.Add(-dirtyBeforeSave)
+		lastSaveTime = time.Now().Unix()
+		fmt.Println("Background saving terminated with success")
+	}()
+
+	return nil
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rdbEofMarkSize = 40
+
+// Like Redis' hard client-output-buffer-limit for replicas: one that falls
+// this far behind is dropped and has to resync.
+const replicaOutputBufferLimit = 256 * 1024 * 1024
+
+var masterReplOffset = int64(0)
+var backlog = newReplicationBacklog(1 << 20)
+
+// Replicas that followed our previous master (replid2) may continue from
+// any offset up to secondReplOffset.
+var secondReplOffset = int64(-1)
+
+// The backlog is a ring buffer holding the most recent bytes of the
+// replication stream. Byte i of the stream (counting from 0) lives at
+// buffer[i % size] for as long as it hasn't been overwritten.
+type replicationBacklog struct {
+	buffer  []byte
+	histlen int64
+}
+
+func newReplicationBacklog(size int64) *replicationBacklog {
+	return &replicationBacklog{buffer: make([]byte, size)}
+}
+
+func (b *replicationBacklog) firstByteOffset() int64 {
+	return masterReplOffset - b.histlen
+}
+
+func (b *replicationBacklog) writeAt(data []byte, offset int64) {
+	size := int64(len(b.buffer))
+	if int64(len(data)) > size {
+		offset += int64(len(data)) - size
+		data = data[int64(len(data))-size:]
+	}
+
+	for len(data) > 0 {
+		n := copy(b.buffer[offset%size:], data)
+		data = data[n:]
+		offset += int64(n)
+	}
+}
+
+// Must be called before masterReplOffset is advanced past data.
+func (b *replicationBacklog) feed(data []byte) {
+	b.writeAt(data, masterReplOffset)
+	b.histlen = min(b.histlen+int64(len(data)), int64(len(b.buffer)))
+}
+
+func (b *replicationBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < b.firstByteOffset() || offset > masterReplOffset {
+		return nil, false
+	}
+
+	size := int64(len(b.buffer))
+	data := make([]byte, 0, masterReplOffset-offset)
+	for pos := offset; pos < masterReplOffset; {
+		idx := pos % size
+		end := min(size, idx+masterReplOffset-pos)
+		data = append(data, b.buffer[idx:end]...)
+		pos += end - idx
+	}
+
+	return data, true
+}
+
+func resizeReplicationBacklog(value string) error {
+	size, err := parseMemory(value)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("backlog size must be positive")
+	}
+
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	if size == int64(len(backlog.buffer)) {
+		return nil
+	}
+
+	history, _ := backlog.readFrom(backlog.firstByteOffset())
+	resized := newReplicationBacklog(size)
+	resized.writeAt(history, masterReplOffset-int64(len(history)))
+	resized.histlen = min(int64(len(history)), size)
+	backlog = resized
+
+	return nil
+}
+
+func forwardCommandToReplicas(command string) int64 {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	backlog.feed([]byte(command))
+	masterReplOffset += int64(len(command))
+
+	for _, replica := range replicas {
+		if len(replica.outputBuffer)+len(command) > replicaOutputBufferLimit {
+			fmt.Printf("Replica %s:%s is too far behind, dropping it\n", replica.ip, replica.port)
+			removeReplicaLocked(replica)
+			continue
+		}
+		queueReplicaOutputLocked(replica, []byte(command))
+	}
+
+	return masterReplOffset
+}
+
+func queueReplicaOutputLocked(replica *Replica, output []byte) {
+	replica.outputBuffer = append(replica.outputBuffer, output...)
+	select {
+	case replica.outputReady <- struct{}{}:
+	default:
+	}
+}
+
+func runReplicaWriter(replica *Replica) {
+	for {
+		select {
+		case <-replica.stopped:
+			return
+		case <-replica.outputReady:
+		}
+
+		replicasLock.Lock()
+		if replica.state != "online" {
+			replicasLock.Unlock()
+			continue
+		}
+		output := replica.outputBuffer
+		replica.outputBuffer = nil
+		replicasLock.Unlock()
+
+		if _, err := (replicaWriter{replica.conn}).Write(output); err != nil {
+			fmt.Println("Failed to relay command to replica, dropping it:", err.Error())
+			removeReplica(replica)
+			return
+		}
+	}
+}
+
+// Every write to a replica has to make progress within repl-timeout, or the
+// replica is considered stuck.
+type replicaWriter struct {
+	conn net.Conn
+}
+
+func (w replicaWriter) Write(p []byte) (int, error) {
+	timeout, err := strconv.ParseInt(getConfig("repl-timeout"), 10, 64)
+	if err == nil && timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		defer w.conn.SetWriteDeadline(time.Time{})
+	}
+
+	return w.conn.Write(p)
+}
+
+func acknowledgeReplicaOffset(replica *Replica, offset int64) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	if offset > replica.ackedOffset {
+		replica.ackedOffset = offset
+	}
+	replica.lastAckTime = time.Now()
+	close(replicaAcked)
+	replicaAcked = make(chan struct{})
+}
+
+// Also returns the channel that will be closed on the next acknowledgement,
+// so callers can wait for the count to change without missing one.
+func countReplicasAcked(offset int64) (int, <-chan struct{}) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	numAcks := 0
+	for _, replica := range replicas {
+		if replica.ackedOffset >= offset {
+			numAcks++
+		}
+	}
+
+	return numAcks, replicaAcked
+}
+
+// A replica asking to continue from an offset we still hold in the backlog
+// only needs the bytes it missed, not a whole new snapshot.
+func tryPartialResync(client *Client, replId string, psyncOffset int64) *Replica {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	sameHistory := replId == getConfig("replId") ||
+		(replId == getConfig("replId2") && psyncOffset <= secondReplOffset)
+	if !sameHistory {
+		return nil
+	}
+
+	missing, ok := backlog.readFrom(psyncOffset - 1)
+	if !ok {
+		return nil
+	}
+
+	replica := newReplica(client)
+	replica.ackedOffset = psyncOffset - 1
+	response := fmt.Sprintf("+CONTINUE %s\r\n", getConfig("replId"))
+	queueReplicaOutputLocked(replica, append([]byte(response), missing...))
+	replicas = append(replicas, replica)
+	return replica
+}
+
+// After a full resync a replica takes on its master's replid and offset, and
+// its own replicas have to start over since their history is gone.
+func resetReplicationHistory(replId string, offset int64) {
+	disconnectReplicas()
+
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	setConfig("replId", replId)
+	setConfig("replId2", strings.Repeat("0", 40))
+	secondReplOffset = -1
+	masterReplOffset = offset
+	backlog = newReplicationBacklog(int64(len(backlog.buffer)))
+}
+
+// A partial resync with a master that has a new replid (because it was
+// promoted) keeps our history, so our own replicas can still continue with
+// either id once they reconnect.
+func inheritReplicationId(replId string) {
+	if replId == getConfig("replId") {
+		return
+	}
+
+	disconnectReplicas()
+
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	setConfig("replId2", getConfig("replId"))
+	secondReplOffset = masterReplOffset + 1
+	setConfig("replId", replId)
+}
+
+func disconnectReplicas() {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	for _, replica := range replicas {
+		replica.conn.Close()
+		close(replica.stopped)
+	}
+	replicas = []*Replica{}
+}
+
+func newReplica(client *Client) *Replica {
+	ip := client.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	replica := &Replica{
+		conn:        client.conn,
+		ip:          ip,
+		port:        client.listeningPort,
+		lastAckTime: time.Now(),
+		state:       "online",
+		outputReady: make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+	}
+	go runReplicaWriter(replica)
+
+	return replica
+}
+
+func removeReplica(replica *Replica) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	removeReplicaLocked(replica)
+}
+
+func removeReplicaLocked(replica *Replica) {
+	for i, curr := range replicas {
+		if curr == replica {
+			replica.conn.Close()
+			close(replica.stopped)
+			replicas = append(replicas[:i:i], replicas[i+1:]...)
+			return
+		}
+	}
+}
+
+// Replicas ACK once a second, so one that stays silent for longer than
+// repl-timeout is considered gone.
+func runReplicaTimeoutLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		timeout, err := strconv.ParseInt(getConfig("repl-timeout"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		replicasLock.Lock()
+		for _, replica := range replicas {
+			if replica.state == "online" && time.Since(replica.lastAckTime) > time.Duration(timeout)*time.Second {
+				fmt.Printf("Replica %s:%s timed out, dropping it\n", replica.ip, replica.port)
+				removeReplicaLocked(replica)
+			}
+		}
+		replicasLock.Unlock()
+	}
+}
+
+// The master PINGs its replicas every repl-ping-replica-period, so that a
+// replica sees traffic on an idle link and can tell it apart from a dead one.
+func runReplicaPingLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for seconds := int64(1); ; seconds++ {
+		<-ticker.C
+		period, err := strconv.ParseInt(getConfig("repl-ping-replica-period"), 10, 64)
+		if err != nil || seconds%period != 0 {
+			continue
+		}
+
+		replicasLock.Lock()
+		hasReplicas := len(replicas) > 0
+		replicasLock.Unlock()
+
+		if getConfig("role") == "master" && hasReplicas {
+			forwardCommandToReplicas(toRespArr("PING"))
+		}
+	}
+}
+
+func addReplicasInfo(response *string) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	addToInfoResponse("connected_slaves", strconv.Itoa(len(replicas)), response)
+	for i, replica := range replicas {
+		lag := int64(time.Since(replica.lastAckTime).Seconds())
+		addToInfoResponse(
+			fmt.Sprintf("slave%d", i),
+			fmt.Sprintf("ip=%s,port=%s,state=%s,offset=%d,lag=%d", replica.ip, replica.port, replica.state, replica.ackedOffset, lag),
+			response,
+		)
+	}
+}
+
+// Writes from regular clients are refused on a read only replica and on a
+// master without enough good replicas. The master link itself is never
+// refused, as that is how a replica's data gets written.
+func rejectWrite(commandName string, client *Client) error {
+	if client.fromMaster || !writesData(commandName, client) {
+		return nil
+	}
+
+	if getConfig("role") == "slave" && getConfig("replica-read-only") == "yes" {
+		return readOnlyReplicaErr
+	}
+	if !hasEnoughGoodReplicas() {
+		return noReplicasErr
+	}
+
+	return nil
+}
+
+func writesData(commandName string, client *Client) bool {
+	if commandName != "exec" {
+		return commands[commandName].isWrite
+	}
+
+	for _, command := range client.commandQueue {
+		if commands[command[0]].isWrite {
+			return true
+		}
+	}
+	return false
+}
+
+// With min-replicas-to-write set, a master only accepts writes while enough
+// replicas have acknowledged within min-replicas-max-lag seconds.
+func hasEnoughGoodReplicas() bool {
+	if getConfig("role") != "master" {
+		return true
+	}
+
+	minReplicas, err := strconv.Atoi(getConfig("min-replicas-to-write"))
+	if err != nil || minReplicas == 0 {
+		return true
+	}
+	maxLag, err := strconv.ParseInt(getConfig("min-replicas-max-lag"), 10, 64)
+	if err != nil {
+		return true
+	}
+
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	goodReplicas := 0
+	for _, replica := range replicas {
+		if replica.state == "online" && int64(time.Since(replica.lastAckTime).Seconds()) <= maxLag {
+			goodReplicas++
+		}
+	}
+
+	return goodReplicas >= minReplicas
+}
+
+// Replicas that understand the EOF format get the snapshot encoded straight
+// onto the socket, terminated by a random mark since the length isn't known
+// upfront. Others get it from a temp file so the length can be sent first.
+func sendSnapshot(client *Client, items map[string]CacheItem) error {
+	if client.capaEof && getConfig("repl-diskless-sync") == "yes" {
+		mark := make([]byte, rdbEofMarkSize/2)
+		rand.Read(mark)
+		eofMark := hex.EncodeToString(mark)
+
+		writer := bufio.NewWriter(replicaWriter{client.conn})
+		writer.WriteString("$EOF:" + eofMark + "\r\n")
+		if err := encodeRdb(writer, items); err != nil {
+			return fmt.Errorf("error streaming snapshot: %w", err)
+		}
+		writer.WriteString(eofMark)
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("error streaming snapshot: %w", err)
+		}
+		return nil
+	}
+
+	dir := getConfig("dir")
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "temp-sync-*.rdb")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := encodeRdb(file, items); err != nil {
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading snapshot file: %w", err)
+	}
+
+	conn := replicaWriter{client.conn}
+	if _, err := conn.Write([]byte(fmt.Sprintf("$%d\r\n", size))); err != nil {
+		return fmt.Errorf("error sending snapshot: %w", err)
+	}
+	if _, err := io.Copy(conn, file); err != nil {
+		return fmt.Errorf("error sending snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func markReplicaOnline(replica *Replica) {
+	replicasLock.Lock()
+	defer replicasLock.Unlock()
+
+	replica.state = "online"
+	replica.lastAckTime = time.Now()
+	queueReplicaOutputLocked(replica, nil)
+}
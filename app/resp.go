@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Longest inline command or header line (`*<count>`, `$<len>`) accepted
+// from a client.
+const protoInlineMaxSize = 64 * 1024
+const protoMaxMultibulkLen = 1024 * 1024
+
+var protoMaxBulkLen atomic.Int64
+
+// A malformed request. The client gets the message as an error reply and
+// is then disconnected, since there's no way to find the next command.
+type protocolError struct {
+	message string
+}
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + e.message
+}
+
+func setProtoMaxBulkLen(value string) error {
+	size, err := parseMemory(value)
+	if err != nil {
+		return err
+	}
+	if size < 1024*1024 {
+		return fmt.Errorf("must be at least 1mb")
+	}
+
+	protoMaxBulkLen.Store(size)
+	return nil
+}
+
+// Reads one line including its "\n". Lines longer than protoInlineMaxSize
+// are rejected with tooBigMessage instead of buffering them without bound.
+func readLine(reader *bufio.Reader, tooBigMessage string) ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > protoInlineMaxSize {
+			return nil, protocolError{tooBigMessage}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+// Reads one CRLF-terminated line without the terminator.
+func readRespLine(reader *bufio.Reader, tooBigMessage string) ([]byte, error) {
+	line, err := readLine(reader, tooBigMessage)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, protocolError{"expected CRLF line terminator"}
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// Reads the next command, either a `*<count>` array of bulk strings or an
+// inline command typed by hand (e.g. over telnet). rawCommand is exactly
+// what was consumed from reader, which replication needs for offset
+// accounting and relaying.
+func parseRespCommand(reader *bufio.Reader) (rawCommand string, commandName string, args []string, err error) {
+	raw := []byte{}
+	defer func() {
+		rawCommand = string(raw)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+	}()
+
+	// Blank lines and empty arrays don't make a command and are skipped.
+	parts := []string{}
+	for len(parts) == 0 {
+		var first []byte
+		first, err = reader.Peek(1)
+		if err != nil {
+			return
+		}
+
+		if first[0] == '*' {
+			parts, err = readMultibulkCommand(reader, &raw)
+		} else {
+			parts, err = readInlineCommand(reader, &raw)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	commandName = strings.ToLower(parts[0])
+	args = parts[1:]
+	return
+}
+
+// Bulk strings are read by their declared length, so values may contain
+// any bytes including CRLF.
+func readMultibulkCommand(reader *bufio.Reader, raw *[]byte) ([]string, error) {
+	header, err := readRespLine(reader, "too big mbulk count string")
+	if err != nil {
+		return nil, err
+	}
+	*raw = append(append(*raw, header...), '\r', '\n')
+
+	count, err := strconv.Atoi(string(header[1:]))
+	if err != nil || count > protoMaxMultibulkLen {
+		return nil, protocolError{"invalid multibulk length"}
+	}
+
+	parts := make([]string, 0, max(min(count, 1024), 0))
+	for range count {
+		header, err := readRespLine(reader, "too big bulk count string")
+		if err != nil {
+			return nil, err
+		}
+		*raw = append(append(*raw, header...), '\r', '\n')
+
+		if len(header) == 0 || header[0] != '$' {
+			got := "\\r"
+			if len(header) > 0 {
+				got = string(header[0])
+			}
+			return nil, protocolError{fmt.Sprintf("expected '$', got '%s'", got)}
+		}
+
+		length, err := strconv.ParseInt(string(header[1:]), 10, 64)
+		if err != nil || length < 0 || length > protoMaxBulkLen.Load() {
+			return nil, protocolError{"invalid bulk length"}
+		}
+
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		*raw = append(*raw, data...)
+
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, protocolError{"expected CRLF after bulk string"}
+		}
+		parts = append(parts, string(data[:length]))
+	}
+
+	return parts, nil
+}
+
+// Inline commands are one line of space separated arguments, terminated by
+// "\n" or "\r\n", and quoted the same way redis-cli quotes them.
+func readInlineCommand(reader *bufio.Reader, raw *[]byte) ([]string, error) {
+	line, err := readLine(reader, "too big inline request")
+	if err != nil {
+		return nil, err
+	}
+	*raw = append(*raw, line...)
+
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	parts, ok := splitInlineArgs(string(line))
+	if !ok {
+		return nil, protocolError{"unbalanced quotes in request"}
+	}
+
+	return parts, nil
+}
+
+// Splits a line into arguments the way redis-cli does. Double quoted
+// arguments understand \n, \r, \t, \b, \a and \xHH escapes, single quoted
+// ones only \'. A closing quote must be followed by a space or the end of
+// the line. Returns false for unbalanced quotes.
+func splitInlineArgs(line string) ([]string, bool) {
+	isSpace := func(c byte) bool {
+		return strings.IndexByte(" \t\n\r\v\f", c) >= 0
+	}
+	isHex := func(c byte) bool {
+		return strings.IndexByte("0123456789abcdefABCDEF", c) >= 0
+	}
+
+	args := []string{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, true
+		}
+
+		current := []byte{}
+		inDoubleQuotes, inSingleQuotes := false, false
+		for done := false; !done; {
+			switch {
+			case inDoubleQuotes:
+				if i == len(line) {
+					return nil, false
+				}
+				c := line[i]
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					value, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(value))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					escaped := line[i]
+					switch escaped {
+					case 'n':
+						escaped = '\n'
+					case 'r':
+						escaped = '\r'
+					case 't':
+						escaped = '\t'
+					case 'b':
+						escaped = '\b'
+					case 'a':
+						escaped = '\a'
+					}
+					current = append(current, escaped)
+				} else if c == '"' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			case inSingleQuotes:
+				if i == len(line) {
+					return nil, false
+				}
+				c := line[i]
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					continue
+				}
+				switch c := line[i]; {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDoubleQuotes = true
+				case c == '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, string(current))
+	}
+}
+
+// An error reply whose message starts with its own error code, e.g.
+// "WRONGTYPE ...". Any other error a handler returns is sent with the
+// generic ERR code.
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// Reply is how command handlers respond. Each call writes one value, and
+// Array, Map, Set and Push are followed by the calls for their elements.
+// Types that only exist in RESP3 fall back to the closest RESP2 shape for
+// clients that haven't switched with HELLO 3.
+type Reply interface {
+	Protocol() int
+	Status(status string)
+	Error(err error)
+	Int(n int64)
+	Bulk(s string)
+	Null()
+	NullArray()
+	Array(length int)
+	Map(length int)
+	Set(length int)
+	Push(length int)
+	Double(value float64)
+	Bool(value bool)
+	BigNumber(value string)
+	Verbatim(format string, text string)
+	Flush() error
+}
+
+type respWriter struct {
+	w      *bufio.Writer
+	client *Client
+}
+
+func newRespWriter(w io.Writer, client *Client) *respWriter {
+	return &respWriter{w: bufio.NewWriter(w), client: client}
+}
+
+func (r *respWriter) Protocol() int {
+	if r.client.protocol == 0 {
+		return 2
+	}
+	return r.client.protocol
+}
+
+func (r *respWriter) header(prefix byte, length int) {
+	r.w.WriteByte(prefix)
+	r.w.WriteString(strconv.Itoa(length))
+	r.w.WriteString("\r\n")
+}
+
+func (r *respWriter) line(prefix byte, s string) {
+	r.w.WriteByte(prefix)
+	r.w.WriteString(s)
+	r.w.WriteString("\r\n")
+}
+
+func (r *respWriter) Status(status string) {
+	r.line('+', status)
+}
+
+func (r *respWriter) Error(err error) {
+	message := err.Error()
+	if _, ok := err.(replyError); !ok {
+		message = "ERR " + message
+	}
+	r.line('-', strings.NewReplacer("\r", " ", "\n", " ").Replace(message))
+}
+
+func (r *respWriter) Int(n int64) {
+	r.line(':', strconv.FormatInt(n, 10))
+}
+
+func (r *respWriter) Bulk(s string) {
+	r.header('$', len(s))
+	r.w.WriteString(s)
+	r.w.WriteString("\r\n")
+}
+
+func (r *respWriter) Null() {
+	if r.Protocol() == 3 {
+		r.w.WriteString("_\r\n")
+		return
+	}
+	r.w.WriteString(nullRespStr)
+}
+
+func (r *respWriter) NullArray() {
+	if r.Protocol() == 3 {
+		r.w.WriteString("_\r\n")
+		return
+	}
+	r.w.WriteString("*-1\r\n")
+}
+
+func (r *respWriter) Array(length int) {
+	r.header('*', length)
+}
+
+// A map of length pairs. RESP2 clients get them flattened into one array.
+func (r *respWriter) Map(length int) {
+	if r.Protocol() == 3 {
+		r.header('%', length)
+		return
+	}
+	r.header('*', length*2)
+}
+
+func (r *respWriter) Set(length int) {
+	if r.Protocol() == 3 {
+		r.header('~', length)
+		return
+	}
+	r.header('*', length)
+}
+
+// Out-of-band messages that aren't a reply to any command. RESP2 has no
+// such frame, so they're sent as plain arrays there.
+func (r *respWriter) Push(length int) {
+	if r.Protocol() == 3 {
+		r.header('>', length)
+		return
+	}
+	r.header('*', length)
+}
+
+func (r *respWriter) Double(value float64) {
+	formatted := strconv.FormatFloat(value, 'g', 17, 64)
+	if r.Protocol() != 3 {
+		r.Bulk(formatted)
+		return
+	}
+	switch {
+	case math.IsInf(value, 1):
+		formatted = "inf"
+	case math.IsInf(value, -1):
+		formatted = "-inf"
+	}
+	r.line(',', formatted)
+}
+
+func (r *respWriter) Bool(value bool) {
+	if r.Protocol() != 3 {
+		if value {
+			r.Int(1)
+		} else {
+			r.Int(0)
+		}
+		return
+	}
+
+	if value {
+		r.line('#', "t")
+	} else {
+		r.line('#', "f")
+	}
+}
+
+func (r *respWriter) BigNumber(value string) {
+	if r.Protocol() != 3 {
+		r.Bulk(value)
+		return
+	}
+	r.line('(', value)
+}
+
+// Free-form text such as INFO-style reports. format is the three letter
+// hint RESP3 clients use to decide how to display it ("txt" or "mkd").
+func (r *respWriter) Verbatim(format string, text string) {
+	if r.Protocol() != 3 {
+		r.Bulk(text)
+		return
+	}
+	r.header('=', len(text)+4)
+	r.w.WriteString(format)
+	r.w.WriteByte(':')
+	r.w.WriteString(text)
+	r.w.WriteString("\r\n")
+}
+
+func (r *respWriter) Flush() error {
+	return r.w.Flush()
+}
+
+// Sits between a client's connection and its bufio.Reader so pending
+// replies are written whenever the reader has to wait for more input, such
+// as when a pipelined command arrives split across reads.
+type flushingReader struct {
+	conn  net.Conn
+	reply Reply
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	if err := r.reply.Flush(); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
+// INFO reports are "key:value" lines grouped under "# Section" headers.
+// RESP3 clients get the fields as a map instead of text to parse.
+func replyWithInfo(reply Reply, report string) {
+	if reply.Protocol() != 3 {
+		reply.Bulk(report)
+		return
+	}
+
+	fields := [][2]string{}
+	for _, line := range strings.Split(report, "\r\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && !strings.HasPrefix(line, "#") {
+			fields = append(fields, [2]string{key, value})
+		}
+	}
+	reply.Map(len(fields))
+	for _, field := range fields {
+		reply.Bulk(field[0])
+		reply.Bulk(field[1])
+	}
+}
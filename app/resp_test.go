@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRespCommand(t *testing.T) {
+	protoMaxBulkLen.Store(1024 * 1024)
+
+	tests := []struct {
+		name    string
+		input   string
+		command string
+		args    []string
+		raw     string
+	}{
+		{"no args", "*1\r\n$4\r\nPING\r\n", "ping", []string{}, "*1\r\n$4\r\nPING\r\n"},
+		{"args keep their case", "*3\r\n$3\r\nSET\r\n$1\r\nK\r\n$1\r\nV\r\n", "set", []string{"K", "V"}, ""},
+		{"empty bulk", "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", "echo", []string{""}, ""},
+		{"crlf inside bulk", "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", "echo", []string{"a\r\nb"}, ""},
+		{"binary bulk", "*2\r\n$4\r\nECHO\r\n$3\r\n\x00\xff*\r\n", "echo", []string{"\x00\xff*"}, ""},
+		{"empty arrays are skipped", "*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n", "ping", []string{}, "*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n"},
+		{"only the first command", "*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n", "ping", []string{}, "*1\r\n$4\r\nPING\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, command, args, err := parseRespCommand(bufio.NewReader(strings.NewReader(test.input)))
+			if err != nil {
+				t.Fatalf("parseRespCommand: %v", err)
+			}
+			if command != test.command || !reflect.DeepEqual(args, test.args) {
+				t.Errorf("parseRespCommand = %q %q, want %q %q", command, args, test.command, test.args)
+			}
+			wantRaw := test.raw
+			if wantRaw == "" {
+				wantRaw = test.input
+			}
+			if raw != wantRaw {
+				t.Errorf("raw = %q, want %q", raw, wantRaw)
+			}
+		})
+	}
+}
+
+func TestParseRespCommandErrors(t *testing.T) {
+	protoMaxBulkLen.Store(1024 * 1024)
+
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"multibulk length not a number", "*x\r\n", protocolError{"invalid multibulk length"}},
+		{"multibulk length too large", "*1048577\r\n", protocolError{"invalid multibulk length"}},
+		{"multibulk count too long", "*" + strings.Repeat("1", protoInlineMaxSize) + "\r\n", protocolError{"too big mbulk count string"}},
+		{"missing dollar", "*1\r\n:1\r\n", protocolError{"expected '$', got ':'"}},
+		{"empty bulk header", "*1\r\n\r\n", protocolError{"expected '$', got '\\r'"}},
+		{"bulk length not a number", "*1\r\n$x\r\n", protocolError{"invalid bulk length"}},
+		{"negative bulk length", "*1\r\n$-1\r\n", protocolError{"invalid bulk length"}},
+		{"bulk longer than proto-max-bulk-len", "*1\r\n$1048577\r\n", protocolError{"invalid bulk length"}},
+		{"bulk count too long", "*1\r\n$" + strings.Repeat("1", protoInlineMaxSize) + "\r\n", protocolError{"too big bulk count string"}},
+		{"bulk longer than declared", "*1\r\n$3\r\nPINGX\r\n", protocolError{"expected CRLF after bulk string"}},
+		{"header without CR", "*1\n$4\r\nPING\r\n", protocolError{"expected CRLF line terminator"}},
+		{"bulk header without CR", "*1\r\n$4\nPING\r\n", protocolError{"expected CRLF line terminator"}},
+		{"nothing to read", "", io.EOF},
+		{"cut off in a header", "*1\r\n$4", io.EOF},
+		{"cut off in a bulk", "*1\r\n$4\r\nPI", io.EOF},
+		{"cut off before the final CRLF", "*1\r\n$4\r\nPING", io.EOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := parseRespCommand(bufio.NewReader(strings.NewReader(test.input)))
+			if err != test.want {
+				t.Errorf("parseRespCommand error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRespCommandInline(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		command string
+		args    []string
+		raw     string
+	}{
+		{"crlf", "PING\r\n", "ping", []string{}, "PING\r\n"},
+		{"bare lf", "set a b\n", "set", []string{"a", "b"}, "set a b\n"},
+		{"blank lines are skipped", "\r\n  \n\tPING\r\n", "ping", []string{}, "\r\n  \n\tPING\r\n"},
+		{"quoted args", "SET k \"v 1\" 'x y'\r\n", "set", []string{"k", "v 1", "x y"}, "SET k \"v 1\" 'x y'\r\n"},
+		{"only the first line", "PING\r\nECHO a\r\n", "ping", []string{}, "PING\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, command, args, err := parseRespCommand(bufio.NewReader(strings.NewReader(test.input)))
+			if err != nil {
+				t.Fatalf("parseRespCommand: %v", err)
+			}
+			if command != test.command || !reflect.DeepEqual(args, test.args) || raw != test.raw {
+				t.Errorf("parseRespCommand = %q %q %q, want %q %q %q", command, args, raw, test.command, test.args, test.raw)
+			}
+		})
+	}
+}
+
+func TestParseRespCommandInlineErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"unbalanced double quotes", "SET k \"v\r\n", protocolError{"unbalanced quotes in request"}},
+		{"unbalanced single quotes", "SET k 'v\r\n", protocolError{"unbalanced quotes in request"}},
+		{"text after closing quote", "SET k \"v\"x\r\n", protocolError{"unbalanced quotes in request"}},
+		{"line too long", strings.Repeat("a", protoInlineMaxSize+1), protocolError{"too big inline request"}},
+		{"no line ending", "PING", io.EOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := parseRespCommand(bufio.NewReader(strings.NewReader(test.input)))
+			if err != test.want {
+				t.Errorf("parseRespCommand error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitInlineArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"set a b", []string{"set", "a", "b"}},
+		{"  set \t a\v\fb  ", []string{"set", "a", "b"}},
+		{`""`, []string{""}},
+		{`'' ""`, []string{"", ""}},
+		{`set k "hello world"`, []string{"set", "k", "hello world"}},
+		{`"a\nb\rc\td\be\af"`, []string{"a\nb\rc\td\be\af"}},
+		{`"\x41\x6a\x7A"`, []string{"Ajz"}},
+		{`"\x4" "\xZZ"`, []string{"x4", "xZZ"}},
+		{`"say \"hi\"" "back\\slash" "\q"`, []string{`say "hi"`, `back\slash`, "q"}},
+		{`'it\'s'`, []string{"it's"}},
+		{`'a\nb' 'x"y'`, []string{`a\nb`, `x"y`}},
+		{`"x'y"`, []string{"x'y"}},
+		{`a"b c"d`, nil},
+		{`a"b c" d`, []string{"ab c", "d"}},
+		{`"abc"def`, nil},
+		{`'abc'def`, nil},
+		{`"abc`, nil},
+		{`'abc`, nil},
+		{`"abc\"`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			args, ok := splitInlineArgs(test.line)
+			if ok != (test.want != nil) {
+				t.Fatalf("splitInlineArgs(%q) ok = %v, want %v", test.line, ok, test.want != nil)
+			}
+			if ok && !reflect.DeepEqual(args, test.want) {
+				t.Errorf("splitInlineArgs(%q) = %q, want %q", test.line, args, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const bgsaveRetryDelaySeconds = 5
+
+var dirty = atomic.Int64{}
+
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+func markDirty(changes int64) {
+	dirty.Add(changes)
+}
+
+func parseSaveRules(value string) ([]saveRule, error) {
+	parts := strings.Fields(value)
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("save rules must be seconds/changes pairs")
+	}
+
+	rules := []saveRule{}
+	for i := 0; i < len(parts); i += 2 {
+		seconds, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save seconds %q", parts[i])
+		}
+		changes, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save changes %q", parts[i+1])
+		}
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+
+	return rules, nil
+}
+
+func saveRulesMatch(rules []saveRule, now int64) bool {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	if bgsaveInProgress {
+		return false
+	}
+	if !lastBgsaveOk && now-lastBgsaveTry < bgsaveRetryDelaySeconds {
+		return false
+	}
+
+	changes := dirty.Load()
+	for _, rule := range rules {
+		if changes >= rule.changes && now-lastSaveTime >= rule.seconds {
+			return true
+		}
+	}
+
+	return false
+}
+
+func runSaveScheduler() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rules, err := parseSaveRules(getConfig("save"))
+		if err != nil || len(rules) == 0 {
+			continue
+		}
+
+		if saveRulesMatch(rules, time.Now().Unix()) {
+			fmt.Printf("%d changes since last save, saving...\n", dirty.Load())
+			if err := startBgsave(); err != nil && err != errBgsaveInProgress {
+				fmt.Println("Error starting scheduled background save:", err.Error())
+			}
+		}
+	}
+}
+
+func saveOnShutdown() {
+	rules, err := parseSaveRules(getConfig("save"))
+	if err != nil || len(rules) == 0 {
+		return
+	}
+
+	fmt.Println("Saving the final RDB snapshot before exiting")
+	for {
+		err := saveRdb()
+		if err == nil {
+			return
+		}
+		if err != errBgsaveInProgress {
+			fmt.Println("Error saving the final RDB snapshot:", err.Error())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
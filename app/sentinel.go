@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const sentinelDefaultPort = "26379"
+const sentinelTickInterval = time.Second
+
+type sentinelInstance struct {
+	address    string
+	lastPingOk time.Time
+	role       string
+	masterAddr string
+	offset     int64
+}
+
+// A sentinel watches one master and its replicas. Failure detection needs
+// quorum sentinels to agree the master is down, and the failover itself is
+// run by the one sentinel that wins a majority of votes for the epoch.
+type sentinelState struct {
+	lock sync.Mutex
+
+	myId         string
+	name         string
+	quorum       int
+	peers        []string
+	downAfter    time.Duration
+	failoverWait time.Duration
+
+	master   *sentinelInstance
+	replicas map[string]*sentinelInstance
+
+	currentEpoch    int64
+	leaderEpoch     int64
+	leader          string
+	lastFailoverTry time.Time
+	numFailovers    int
+}
+
+var sentinel *sentinelState
+
+func runSentinel(monitor string, peers string) {
+	if getConfig("port") == "" {
+		setConfig("port", sentinelDefaultPort)
+	}
+
+	state, err := newSentinelState(monitor, peers)
+	if err != nil {
+		fmt.Println("Invalid sentinel config:", err.Error())
+		os.Exit(1)
+	}
+	sentinel = state
+
+	commands = map[string]Command{
+		"ping":     {handler: pingCommand},
+		"echo":     {handler: echoCommand},
+		"hello":    {handler: helloCommand},
+		"info":     {handler: sentinelInfoCommand},
+		"sentinel": {handler: sentinelCommand},
+	}
+
+	listener, err := net.Listen("tcp", "0.0.0.0:"+getConfig("port"))
+	if err != nil {
+		fmt.Printf("Failed to bind to port %s\n", getConfig("port"))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Sentinel %s monitoring master %s at %s (quorum %d)\n", sentinel.myId, sentinel.name, sentinel.master.address, sentinel.quorum)
+	go listenForAndHandleClientConnections(listener)
+	go runSentinelMonitor()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigs
+
+	fmt.Println("Shutting down sentinel...")
+	listener.Close()
+	os.Exit(0)
+}
+
+func newSentinelState(monitor string, peers string) (*sentinelState, error) {
+	parts := strings.Fields(monitor)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("sentinel-monitor must be \"<name> <host> <port> <quorum>\"")
+	}
+	quorum, err := strconv.Atoi(parts[3])
+	if err != nil || quorum <= 0 {
+		return nil, fmt.Errorf("invalid quorum %q", parts[3])
+	}
+
+	downAfter, err := strconv.ParseInt(getConfig("sentinel-down-after-milliseconds"), 10, 64)
+	if err != nil || downAfter <= 0 {
+		return nil, fmt.Errorf("invalid sentinel-down-after-milliseconds")
+	}
+	failoverWait, err := strconv.ParseInt(getConfig("sentinel-failover-timeout"), 10, 64)
+	if err != nil || failoverWait <= 0 {
+		return nil, fmt.Errorf("invalid sentinel-failover-timeout")
+	}
+
+	peerList := []string{}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peerList = append(peerList, peer)
+		}
+	}
+
+	return &sentinelState{
+		myId:         generateReplId(),
+		name:         parts[0],
+		quorum:       quorum,
+		peers:        peerList,
+		downAfter:    time.Duration(downAfter) * time.Millisecond,
+		failoverWait: time.Duration(failoverWait) * time.Millisecond,
+		master:       &sentinelInstance{address: net.JoinHostPort(parts[1], parts[2]), lastPingOk: time.Now()},
+		replicas:     map[string]*sentinelInstance{},
+	}, nil
+}
+
+func parseInfo(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if key, value, found := strings.Cut(line, ":"); found {
+			fields[key] = value
+		}
+	}
+
+	return fields
+}
+
+// Pings and INFOs an instance, recording what it reports about its role.
+func refreshSentinelInstance(instance *sentinelInstance) map[string]string {
+	if reply, err := sendRequest(instance.address, "PING"); err != nil || len(reply) != 1 || reply[0] != "PONG" {
+		return nil
+	}
+	reply, err := sendRequest(instance.address, "INFO", "replication")
+	if err != nil || len(reply) != 1 {
+		return nil
+	}
+	info := parseInfo(reply[0])
+
+	sentinel.lock.Lock()
+	defer sentinel.lock.Unlock()
+
+	instance.lastPingOk = time.Now()
+	instance.role = info["role"]
+	instance.masterAddr = ""
+	if info["role"] == "slave" {
+		instance.masterAddr = net.JoinHostPort(info["master_host"], info["master_port"])
+	}
+	instance.offset, _ = strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+	return info
+}
+
+func runSentinelMonitor() {
+	ticker := time.NewTicker(sentinelTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sentinel.lock.Lock()
+		master := sentinel.master
+		known := []*sentinelInstance{}
+		for _, replica := range sentinel.replicas {
+			known = append(known, replica)
+		}
+		sentinel.lock.Unlock()
+
+		if info := refreshSentinelInstance(master); info != nil {
+			discoverReplicas(info)
+		}
+		for _, replica := range known {
+			refreshSentinelInstance(replica)
+		}
+
+		if !masterSubjectivelyDown() {
+			reconfigureStrayInstances()
+			continue
+		}
+
+		// Another sentinel may already have promoted one of the replicas.
+		if adoptPromotedReplica() {
+			continue
+		}
+
+		if masterObjectivelyDown() {
+			tryFailover()
+		}
+	}
+}
+
+func discoverReplicas(info map[string]string) {
+	sentinel.lock.Lock()
+	defer sentinel.lock.Unlock()
+
+	for key, value := range info {
+		if !strings.HasPrefix(key, "slave") || !strings.Contains(value, "ip=") {
+			continue
+		}
+
+		fields := map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			if name, field, found := strings.Cut(pair, "="); found {
+				fields[name] = field
+			}
+		}
+		address := net.JoinHostPort(fields["ip"], fields["port"])
+		if _, exists := sentinel.replicas[address]; !exists && address != sentinel.master.address {
+			fmt.Printf("Discovered replica %s of master %s\n", address, sentinel.name)
+			sentinel.replicas[address] = &sentinelInstance{address: address, lastPingOk: time.Now()}
+		}
+	}
+}
+
+func masterSubjectivelyDown() bool {
+	sentinel.lock.Lock()
+	defer sentinel.lock.Unlock()
+
+	return time.Since(sentinel.master.lastPingOk) > sentinel.downAfter
+}
+
+func masterObjectivelyDown() bool {
+	sentinel.lock.Lock()
+	host, port, _ := net.SplitHostPort(sentinel.master.address)
+	epoch := sentinel.currentEpoch
+	peers := sentinel.peers
+	quorum := sentinel.quorum
+	sentinel.lock.Unlock()
+
+	agreeing := 1
+	for _, peer := range peers {
+		reply, err := sendRequest(peer, "SENTINEL", "is-master-down-by-addr", host, port, strconv.FormatInt(epoch, 10), "*")
+		if err == nil && len(reply) == 3 && reply[0] == "1" {
+			agreeing++
+		}
+	}
+
+	return agreeing >= quorum
+}
+
+// Votes are first come, first served per epoch. A sentinel that fails to
+// collect a majority waits failover-timeout before trying a new epoch.
+func tryFailover() {
+	sentinel.lock.Lock()
+	if time.Since(sentinel.lastFailoverTry) < sentinel.failoverWait {
+		sentinel.lock.Unlock()
+		return
+	}
+	sentinel.lastFailoverTry = time.Now()
+	sentinel.lock.Unlock()
+
+	// Spread out the candidates a little so one usually wins outright.
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+
+	sentinel.lock.Lock()
+	sentinel.currentEpoch++
+	epoch := sentinel.currentEpoch
+	if sentinel.leaderEpoch < epoch {
+		sentinel.leaderEpoch = epoch
+		sentinel.leader = sentinel.myId
+	}
+	votedForSelf := sentinel.leader == sentinel.myId
+	host, port, _ := net.SplitHostPort(sentinel.master.address)
+	peers := sentinel.peers
+	quorum := sentinel.quorum
+	myId := sentinel.myId
+	sentinel.lock.Unlock()
+
+	votes := 0
+	if votedForSelf {
+		votes++
+	}
+	for _, peer := range peers {
+		reply, err := sendRequest(peer, "SENTINEL", "is-master-down-by-addr", host, port, strconv.FormatInt(epoch, 10), myId)
+		if err == nil && len(reply) == 3 && reply[1] == myId {
+			votes++
+		}
+	}
+
+	needed := max(quorum, (len(peers)+1)/2+1)
+	if votes < needed {
+		fmt.Printf("Failover election for epoch %d lost with %d/%d votes\n", epoch, votes, needed)
+		return
+	}
+
+	fmt.Printf("Elected leader for epoch %d with %d votes, starting failover\n", epoch, votes)
+	performFailover()
+}
+
+func performFailover() {
+	sentinel.lock.Lock()
+	oldMaster := sentinel.master
+	candidates := []*sentinelInstance{}
+	for _, replica := range sentinel.replicas {
+		if time.Since(replica.lastPingOk) <= sentinel.downAfter {
+			candidates = append(candidates, replica)
+		}
+	}
+	sentinel.lock.Unlock()
+
+	var promoted *sentinelInstance
+	for _, candidate := range candidates {
+		if promoted == nil || candidate.offset > promoted.offset {
+			promoted = candidate
+		}
+	}
+	if promoted == nil {
+		fmt.Println("Failover aborted: no reachable replica to promote")
+		return
+	}
+
+	if _, err := sendRequest(promoted.address, "REPLICAOF", "NO", "ONE"); err != nil {
+		fmt.Printf("Failover aborted: error promoting %s: %s\n", promoted.address, err.Error())
+		return
+	}
+	fmt.Printf("Promoted %s (offset %d) to master\n", promoted.address, promoted.offset)
+
+	switchMaster(promoted)
+	host, port, _ := net.SplitHostPort(promoted.address)
+	for _, replica := range candidates {
+		if replica == promoted {
+			continue
+		}
+		if _, err := sendRequest(replica.address, "REPLICAOF", host, port); err != nil {
+			fmt.Printf("Error reconfiguring replica %s: %s\n", replica.address, err.Error())
+		}
+	}
+
+	fmt.Printf("Failover of %s from %s to %s complete\n", sentinel.name, oldMaster.address, promoted.address)
+}
+
+// The old master stays known as a replica, so it gets reconfigured to
+// follow the new master once it comes back.
+func switchMaster(promoted *sentinelInstance) {
+	sentinel.lock.Lock()
+	defer sentinel.lock.Unlock()
+
+	oldMaster := sentinel.master
+	delete(sentinel.replicas, promoted.address)
+	sentinel.replicas[oldMaster.address] = oldMaster
+	oldMaster.role = ""
+	promoted.lastPingOk = time.Now()
+	sentinel.master = promoted
+	sentinel.numFailovers++
+}
+
+func adoptPromotedReplica() bool {
+	sentinel.lock.Lock()
+	var promoted *sentinelInstance
+	for _, replica := range sentinel.replicas {
+		if replica.role == "master" && time.Since(replica.lastPingOk) <= sentinel.downAfter {
+			promoted = replica
+		}
+	}
+	sentinel.lock.Unlock()
+
+	if promoted == nil {
+		return false
+	}
+
+	fmt.Printf("Master of %s is now %s\n", sentinel.name, promoted.address)
+	switchMaster(promoted)
+	return true
+}
+
+// Replicas that don't follow the current master (including a failed master
+// that came back) are pointed at it, but only while the master is healthy.
+func reconfigureStrayInstances() {
+	sentinel.lock.Lock()
+	masterAddress := sentinel.master.address
+	strays := []string{}
+	for _, replica := range sentinel.replicas {
+		reachable := time.Since(replica.lastPingOk) <= sentinel.downAfter
+		if reachable && replica.role != "" && replica.masterAddr != masterAddress {
+			strays = append(strays, replica.address)
+		}
+	}
+	sentinel.lock.Unlock()
+
+	host, port, _ := net.SplitHostPort(masterAddress)
+	for _, address := range strays {
+		fmt.Printf("Reconfiguring %s to replicate from %s\n", address, masterAddress)
+		if _, err := sendRequest(address, "REPLICAOF", host, port); err != nil {
+			fmt.Printf("Error reconfiguring %s: %s\n", address, err.Error())
+		}
+	}
+}
+
+func sentinelCommand(args []string, client *Client, reply Reply) error {
+	if len(args) == 0 {
+		return wrongArgsErr("sentinel")
+	}
+
+	sentinel.lock.Lock()
+	defer sentinel.lock.Unlock()
+
+	switch strings.ToLower(args[0]) {
+	case "myid":
+		reply.Bulk(sentinel.myId)
+		return nil
+	case "get-master-addr-by-name":
+		if len(args) != 2 {
+			return wrongArgsErr("sentinel|get-master-addr-by-name")
+		}
+		if args[1] != sentinel.name {
+			reply.NullArray()
+			return nil
+		}
+		host, port, _ := net.SplitHostPort(sentinel.master.address)
+		reply.Array(2)
+		reply.Bulk(host)
+		reply.Bulk(port)
+		return nil
+	case "master":
+		if len(args) != 2 {
+			return wrongArgsErr("sentinel|master")
+		}
+		if args[1] != sentinel.name {
+			return replyError("ERR No such master with that name")
+		}
+		host, port, _ := net.SplitHostPort(sentinel.master.address)
+		flags := "master"
+		if time.Since(sentinel.master.lastPingOk) > sentinel.downAfter {
+			flags += ",s_down"
+		}
+		fields := []string{
+			"name", sentinel.name,
+			"ip", host,
+			"port", port,
+			"flags", flags,
+			"num-slaves", strconv.Itoa(len(sentinel.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(sentinel.peers)),
+			"quorum", strconv.Itoa(sentinel.quorum),
+			"config-epoch", strconv.FormatInt(sentinel.currentEpoch, 10),
+		}
+		reply.Map(len(fields) / 2)
+		for _, field := range fields {
+			reply.Bulk(field)
+		}
+		return nil
+	case "is-master-down-by-addr":
+		if len(args) != 5 {
+			return wrongArgsErr("sentinel|is-master-down-by-addr")
+		}
+		epoch, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return notIntegerErr
+		}
+
+		down := int64(0)
+		if net.JoinHostPort(args[1], args[2]) == sentinel.master.address &&
+			time.Since(sentinel.master.lastPingOk) > sentinel.downAfter {
+			down = 1
+		}
+
+		runId := args[4]
+		if runId != "*" {
+			if epoch > sentinel.currentEpoch {
+				sentinel.currentEpoch = epoch
+			}
+			if epoch > sentinel.leaderEpoch {
+				sentinel.leaderEpoch = epoch
+				sentinel.leader = runId
+				fmt.Printf("Voted for %s in epoch %d\n", runId, epoch)
+			}
+		}
+
+		leader, leaderEpoch := "*", int64(0)
+		if runId != "*" && sentinel.leaderEpoch == epoch {
+			leader, leaderEpoch = sentinel.leader, sentinel.leaderEpoch
+		}
+		reply.Array(3)
+		reply.Int(down)
+		reply.Bulk(leader)
+		reply.Int(leaderEpoch)
+		return nil
+	}
+
+	return replyError(fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", args[0]))
+}
+
+func sentinelInfoCommand(args []string, client *Client, reply Reply) error {
+	sentinel.lock.Lock()
+	defer sentinel.lock.Unlock()
+
+	status := "ok"
+	if time.Since(sentinel.master.lastPingOk) > sentinel.downAfter {
+		status = "sdown"
+	}
+
+	response := "# Sentinel"
+	addToInfoResponse("sentinel_masters", "1", &response)
+	addToInfoResponse(
+		"master0",
+		fmt.Sprintf("name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			sentinel.name, status, sentinel.master.address, len(sentinel.replicas), len(sentinel.peers)+1),
+		&response,
+	)
+	addToInfoResponse("sentinel_failovers", strconv.Itoa(sentinel.numFailovers), &response)
+
+	replyWithInfo(reply, response)
+	return nil
+}
@@ -8,14 +8,22 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type CacheItem struct {
 	value     string
 	expiresAt int64
 	itemType  string
+	stream    *Stream
+	list      []string
+	set       map[string]struct{}
+	zset      map[string]float64
+	hash      map[string]string
 }
 
 type StreamEntry struct {
@@ -31,81 +39,242 @@ type Stream struct {
 }
 
 type Client struct {
+	id           int64
 	conn         net.Conn
 	queueFlag    bool
 	commandQueue [][]string
+	fromMaster   bool
+
+	// Write commands record what should reach the AOF and replicas here.
+	// Handlers whose effect isn't deterministic set rewrittenCommand to an
+	// equivalent form that is.
+	rewrittenCommand []string
+	propagation      []string
+
+	// The replication offset right after this client's last write, which
+	// WAIT compares against what replicas have acknowledged.
+	lastWriteOffset int64
+
+	replica       *Replica
+	listeningPort string
+	capaEof       bool
+	asking        bool
+
+	// Set while EXEC runs the queued commands, which must not block since
+	// the transaction may be holding the write barrier.
+	inExec bool
+
+	// On the master link, the raw bytes received but not yet relayed to our
+	// own replicas. A transaction is relayed in one piece once it's applied.
+	pendingRelay []byte
+
+	// The RESP version replies are encoded with, switched by HELLO. Zero
+	// means RESP2.
+	protocol    int
+	name        string
+	replyWriter *respWriter
 }
 
-var keyValueCache = map[string]CacheItem{}
-var streamCache = map[string]*Stream{}
-var configParams = map[string]string{}
+type Replica struct {
+	conn        net.Conn
+	ip          string
+	port        string
+	ackedOffset int64
+	lastAckTime time.Time
+
+	// The replication stream queued for the replica's own writer goroutine,
+	// so a slow replica never holds up the writes being propagated. While the
+	// snapshot is being sent ("send_bulk") it only accumulates.
+	state        string
+	outputBuffer []byte
+	outputReady  chan struct{}
+	stopped      chan struct{}
+}
 
-var replicas = []net.Conn{}
+var replicas = []*Replica{}
 var replicasLock = sync.Mutex{}
 
-var bytesProcessed = 0
-var setHasOccurred = false
+// Closed and replaced (under replicasLock) whenever a replica acknowledges
+// an offset, waking up every blocked WAIT.
+var replicaAcked = make(chan struct{})
+
+var bytesProcessed = atomic.Int64{}
 
-var numAcksSinceLasSet = 0
-var ackLock = sync.Mutex{}
+var lastClientId = atomic.Int64{}
 
 func main() {
 	dirFlag := flag.String("dir", "", "")
 	dbFilenameFlag := flag.String("dbfilename", "", "")
 	portFlag := flag.String("port", "", "")
 	replicaofFlag := flag.String("replicaof", "", "")
+	saveFlag := flag.String("save", "", "")
+	appendOnlyFlag := flag.String("appendonly", "no", "")
+	appendFilenameFlag := flag.String("appendfilename", "appendonly.aof", "")
+	appendFsyncFlag := flag.String("appendfsync", "everysec", "")
+	aofLoadTruncatedFlag := flag.String("aof-load-truncated", "yes", "")
+	autoAofRewritePercentageFlag := flag.String("auto-aof-rewrite-percentage", "100", "")
+	autoAofRewriteMinSizeFlag := flag.String("auto-aof-rewrite-min-size", "64mb", "")
+	replBacklogSizeFlag := flag.String("repl-backlog-size", "1mb", "")
+	replTimeoutFlag := flag.String("repl-timeout", "60", "")
+	replPingReplicaPeriodFlag := flag.String("repl-ping-replica-period", "10", "")
+	minReplicasToWriteFlag := flag.String("min-replicas-to-write", "0", "")
+	minReplicasMaxLagFlag := flag.String("min-replicas-max-lag", "10", "")
+	replicaReadOnlyFlag := flag.String("replica-read-only", "yes", "")
+	replDisklessSyncFlag := flag.String("repl-diskless-sync", "yes", "")
+	protoMaxBulkLenFlag := flag.String("proto-max-bulk-len", "512mb", "")
+	clusterEnabledFlag := flag.String("cluster-enabled", "no", "")
+	clusterAnnounceIpFlag := flag.String("cluster-announce-ip", "127.0.0.1", "")
+	sentinelFlag := flag.Bool("sentinel", false, "")
+	sentinelMonitorFlag := flag.String("sentinel-monitor", "", "")
+	sentinelPeersFlag := flag.String("sentinel-peers", "", "")
+	sentinelDownAfterFlag := flag.String("sentinel-down-after-milliseconds", "5000", "")
+	sentinelFailoverTimeoutFlag := flag.String("sentinel-failover-timeout", "60000", "")
 
 	flag.Parse()
 
-	configParams["dir"] = *dirFlag
-	configParams["dbfilename"] = *dbFilenameFlag
-	configParams["port"] = *portFlag
-	configParams["role"] = "master"
-	configParams["master"] = *replicaofFlag
+	setConfig("dir", *dirFlag)
+	setConfig("dbfilename", *dbFilenameFlag)
+	setConfig("port", *portFlag)
+	setConfig("role", "master")
+	setConfig("master", *replicaofFlag)
+	setConfig("save", *saveFlag)
+	setConfig("appendonly", *appendOnlyFlag)
+	setConfig("appendfilename", *appendFilenameFlag)
+	setConfig("appendfsync", *appendFsyncFlag)
+	setConfig("aof-load-truncated", *aofLoadTruncatedFlag)
+	setConfig("auto-aof-rewrite-percentage", *autoAofRewritePercentageFlag)
+	setConfig("auto-aof-rewrite-min-size", *autoAofRewriteMinSizeFlag)
+	setConfig("repl-backlog-size", *replBacklogSizeFlag)
+	setConfig("repl-timeout", *replTimeoutFlag)
+	setConfig("repl-ping-replica-period", *replPingReplicaPeriodFlag)
+	setConfig("min-replicas-to-write", *minReplicasToWriteFlag)
+	setConfig("min-replicas-max-lag", *minReplicasMaxLagFlag)
+	setConfig("replica-read-only", *replicaReadOnlyFlag)
+	setConfig("repl-diskless-sync", *replDisklessSyncFlag)
+	setConfig("proto-max-bulk-len", *protoMaxBulkLenFlag)
+	setConfig("cluster-enabled", *clusterEnabledFlag)
+	setConfig("cluster-announce-ip", *clusterAnnounceIpFlag)
+	setConfig("sentinel-down-after-milliseconds", *sentinelDownAfterFlag)
+	setConfig("sentinel-failover-timeout", *sentinelFailoverTimeoutFlag)
 
-	if configParams["port"] == "" {
-		configParams["port"] = "6379"
+	if err := setProtoMaxBulkLen(getConfig("proto-max-bulk-len")); err != nil {
+		fmt.Println("Invalid proto-max-bulk-len config:", err.Error())
+		os.Exit(1)
+	}
+
+	if *sentinelFlag {
+		runSentinel(*sentinelMonitorFlag, *sentinelPeersFlag)
+		return
+	}
+
+	if getConfig("port") == "" {
+		setConfig("port", "6379")
 	}
 	if *replicaofFlag != "" {
-		configParams["role"] = "slave"
-	}
-
-	if configParams["role"] == "master" {
-		configParams["replId"] = generateReplId()
-		configParams["replOffset"] = "0"
-	}
-
-	commands = map[string]func([]string, *Client) (string, error){
-		"echo":     echoCommand,
-		"ping":     pingCommand,
-		"set":      setCommand,
-		"get":      getCommand,
-		"config":   configCommand,
-		"keys":     keysCommand,
-		"info":     infoCommand,
-		"replconf": replconfCommand,
-		"psync":    psyncCommand,
-		"wait":     waitCommand,
-		"type":     typeCommand,
-		"xadd":     xaddCommand,
-		"xrange":   xrangeCommand,
-		"xread":    xreadCommand,
-		"incr":     incrCommand,
-		"multi":    multiCommand,
-		"exec":     execCommand,
-		"discard":  discardCommand,
-	}
-
-	listener, err := net.Listen("tcp", "0.0.0.0:"+configParams["port"])
+		setConfig("role", "slave")
+	}
+
+	if getConfig("role") == "master" {
+		setConfig("replId", generateReplId())
+		setConfig("replId2", strings.Repeat("0", 40))
+	}
+
+	commands = map[string]Command{
+		"echo":         {handler: echoCommand},
+		"hello":        {handler: helloCommand},
+		"ping":         {handler: pingCommand},
+		"set":          {handler: setCommand, isWrite: true, getKeys: firstKey},
+		"get":          {handler: getCommand, getKeys: firstKey},
+		"config":       {handler: configCommand},
+		"keys":         {handler: keysCommand},
+		"info":         {handler: infoCommand},
+		"replconf":     {handler: replconfCommand, noMulti: true},
+		"psync":        {handler: psyncCommand, noMulti: true},
+		"wait":         {handler: waitCommand},
+		"type":         {handler: typeCommand, getKeys: firstKey},
+		"xadd":         {handler: xaddCommand, isWrite: true, getKeys: firstKey},
+		"xrange":       {handler: xrangeCommand, getKeys: firstKey},
+		"xread":        {handler: xreadCommand, getKeys: xreadKeys},
+		"incr":         {handler: incrCommand, isWrite: true, getKeys: firstKey},
+		"multi":        {handler: multiCommand},
+		"exec":         {handler: execCommand},
+		"discard":      {handler: discardCommand},
+		"save":         {handler: saveCommand},
+		"bgsave":       {handler: bgsaveCommand},
+		"lastsave":     {handler: lastsaveCommand},
+		"bgrewriteaof": {handler: bgrewriteaofCommand},
+		"replicaof":    {handler: replicaofCommand},
+		"slaveof":      {handler: replicaofCommand},
+		"cluster":      {handler: clusterCommand},
+		"asking":       {handler: askingCommand},
+	}
+
+	if _, err := parseSaveRules(getConfig("save")); err != nil {
+		fmt.Println("Invalid save config:", err.Error())
+		os.Exit(1)
+	}
+	for _, name := range []string{
+		"appendonly",
+		"appendfsync",
+		"aof-load-truncated",
+		"auto-aof-rewrite-percentage",
+		"auto-aof-rewrite-min-size",
+		"repl-backlog-size",
+		"repl-timeout",
+		"repl-ping-replica-period",
+		"min-replicas-to-write",
+		"min-replicas-max-lag",
+		"replica-read-only",
+		"repl-diskless-sync",
+	} {
+		if err := configSetValidators[name](getConfig(name)); err != nil {
+			fmt.Printf("Invalid %s config: %s\n", name, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := validateYesNo(getConfig("cluster-enabled")); err != nil {
+		fmt.Println("Invalid cluster-enabled config:", err.Error())
+		os.Exit(1)
+	}
+
+	if err := resizeReplicationBacklog(getConfig("repl-backlog-size")); err != nil {
+		fmt.Println("Invalid repl-backlog-size config:", err.Error())
+		os.Exit(1)
+	}
+
+	if getConfig("appendonly") == "yes" {
+		if err := loadAppendOnlyFile(); err != nil {
+			fmt.Println("Failed to load append only file:", err.Error())
+			os.Exit(1)
+		}
+		if err := openAppendOnlyFile(); err != nil {
+			fmt.Println("Failed to open append only file:", err.Error())
+			os.Exit(1)
+		}
+	} else if err := loadRdbFile(); err != nil {
+		fmt.Println("Failed to load rdb file:", err.Error())
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", "0.0.0.0:"+getConfig("port"))
 	if err != nil {
-		fmt.Printf("Failed to bind to port %s\n", configParams["port"])
+		fmt.Printf("Failed to bind to port %s\n", getConfig("port"))
 		os.Exit(1)
 	}
 
+	if getConfig("cluster-enabled") == "yes" {
+		initCluster()
+	}
+
 	go listenForAndHandleClientConnections(listener)
+	go runSaveScheduler()
+	go runAofFsyncLoop()
+	go runReplicaTimeoutLoop()
+	go runReplicaPingLoop()
 
-	if configParams["role"] == "slave" {
-		go connectToMaster()
+	if getConfig("role") == "slave" {
+		startReplicationLoop()
 	}
 
 	sigs := make(chan os.Signal, 1)
@@ -114,6 +283,8 @@ func main() {
 	<-sigs
 
 	fmt.Println("Shutting down gracefully...")
+	saveOnShutdown()
+	closeAppendOnlyFile()
 	listener.Close()
 
 	os.Exit(0)
@@ -125,13 +296,14 @@ func listenForAndHandleClientConnections(listener net.Listener) {
 		if err != nil {
 			continue
 		}
-		reader := bufio.NewReader(conn)
-
 		client := Client{
+			id:           lastClientId.Add(1),
 			conn:         conn,
 			queueFlag:    false,
 			commandQueue: [][]string{},
 		}
+		client.replyWriter = newRespWriter(conn, &client)
+		reader := bufio.NewReader(flushingReader{conn: conn, reply: client.replyWriter})
 		go handleClient(&client, reader)
 	}
 }
@@ -139,8 +311,31 @@ func listenForAndHandleClientConnections(listener net.Listener) {
 func handleClient(client *Client, reader *bufio.Reader) {
 	defer client.conn.Close()
 
+	// The master doesn't read replies on the replication link, except for
+	// the ACK it asks for with GETACK.
+	connReply := client.replyWriter
+	discardedReply := newRespWriter(io.Discard, client)
+
 	for {
+		// Pipelined commands already in the buffer are run before their
+		// replies are written, so a batch costs one write instead of one per
+		// command.
+		if reader.Buffered() == 0 {
+			if err := connReply.Flush(); err != nil {
+				fmt.Println("Error sending command response:", err.Error())
+				break
+			}
+		}
+
 		rawCommand, commandName, args, err := parseRespCommand(reader)
+		if protoErr, ok := err.(protocolError); ok {
+			fmt.Println("Closing connection after protocol error:", protoErr.message)
+			if !client.fromMaster {
+				connReply.Error(protoErr)
+				connReply.Flush()
+			}
+			break
+		}
 		if err != nil {
 			if err != io.EOF {
 				fmt.Println("Error reading from connection: ", err.Error())
@@ -148,38 +343,79 @@ func handleClient(client *Client, reader *bufio.Reader) {
 			break
 		}
 
+		reply := connReply
+		isGetAck := commandName == "replconf" && len(args) > 0 && strings.ToLower(args[0]) == "getack"
+		if client.fromMaster && !isGetAck {
+			reply = discardedReply
+		}
+
 		shouldQueueCommand := client.queueFlag && commandName != "exec" && commandName != "discard"
+		if shouldQueueCommand && commands[commandName].noMulti {
+			reply.Error(noMultiErr)
+			continue
+		}
 		if shouldQueueCommand {
 			fmt.Printf("Queueing command: %s\n", commandName)
 			client.commandQueue = append(client.commandQueue, append([]string{commandName}, args...))
-			if _, err := client.conn.Write([]byte("+QUEUED\r\n")); err != nil {
-				fmt.Println("Error responding after queueing command: ", err.Error())
-				break
+			if client.fromMaster {
+				bytesProcessed.Add(int64(len(rawCommand)))
+				client.pendingRelay = append(client.pendingRelay, rawCommand...)
+				continue
 			}
+			reply.Status("QUEUED")
 			continue
 		}
 
-		response, err := runCommand(commandName, args, client)
-		if err != nil {
-			fmt.Printf("Error performing command %s: %s\n", commandName, err.Error())
-		} else if commandName == "set" {
-			fmt.Printf("Forwarding %s to replicas\n", commandName)
-			forwardCommandToReplicas(rawCommand)
+		if err := rejectWrite(commandName, client); err != nil {
+			if commandName == "exec" {
+				client.queueFlag = false
+				client.commandQueue = [][]string{}
+			}
+			reply.Error(err)
+			continue
 		}
 
-		bytesProcessed += len(rawCommand)
-
-		shouldSendResponse := len(response) > 0 && (configParams["role"] == "master" ||
-			commandName == "replconf" ||
-			commandName == "get" ||
-			commandName == "info")
-		if shouldSendResponse {
-			if _, err := client.conn.Write([]byte(response)); err != nil {
-				fmt.Println("Error sending command response:", err.Error())
-				break
+		isWrite := writesData(commandName, client)
+		unlockWriteOrder := func() {}
+		if isWrite {
+			writeBarrier.RLock()
+			unlockWriteOrder = keyspace.LockWriteOrder(commandKeys(commandName, args, client))
+		}
+		if err := runCommand(commandName, args, client, reply); err != nil {
+			replyWithCommandError(reply, commandName, err)
+		}
+		if len(client.propagation) > 0 {
+			propagated := strings.Join(client.propagation, "")
+			client.propagation = nil
+			feedAppendOnlyFile(propagated)
+			// A replica relays its master's stream verbatim below instead, and
+			// writes made directly on a writable replica stay local.
+			if !client.fromMaster && getConfig("role") == "master" {
+				client.lastWriteOffset = forwardCommandToReplicas(propagated)
+			}
+		}
+		if client.fromMaster {
+			client.pendingRelay = append(client.pendingRelay, rawCommand...)
+			if !client.queueFlag {
+				forwardCommandToReplicas(string(client.pendingRelay))
+				client.pendingRelay = nil
 			}
 		}
+		unlockWriteOrder()
+		if isWrite {
+			writeBarrier.RUnlock()
+		}
+
+		if client.fromMaster {
+			bytesProcessed.Add(int64(len(rawCommand)))
+		}
+		if commandName != "asking" {
+			client.asking = false
+		}
 	}
 
+	if client.replica != nil {
+		removeReplica(client.replica)
+	}
 	fmt.Println("Closing client connection")
 }
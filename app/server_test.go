@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Runs handleClient over an in-memory connection, sending each batch of
+// commands in one write. Every command in a batch is read in the same read,
+// so its replies go out in one flush; a pipeline of 1 flushes after every
+// command, like replies did before they were batched.
+func benchmarkHandleClient(b *testing.B, command []string, pipeline int, flushing bool) {
+	commands = map[string]Command{
+		"ping": {handler: pingCommand},
+		"set":  {handler: setCommand, isWrite: true, getKeys: firstKey},
+		"get":  {handler: getCommand, getKeys: firstKey},
+	}
+	protoMaxBulkLen.Store(512 * 1024 * 1024)
+	keyspace.Set("benchmark:key", CacheItem{value: "value", expiresAt: -1, itemType: "string"})
+
+	// Every command is logged, which would dominate the numbers.
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	serverConn, clientConn := net.Pipe()
+
+	client := Client{
+		id:           lastClientId.Add(1),
+		conn:         serverConn,
+		commandQueue: [][]string{},
+	}
+	client.replyWriter = newRespWriter(serverConn, &client)
+	reader := bufio.NewReader(serverConn)
+	if flushing {
+		reader = bufio.NewReader(flushingReader{conn: serverConn, reply: client.replyWriter})
+	}
+	done := make(chan struct{})
+	go func() {
+		handleClient(&client, reader)
+		close(done)
+	}()
+	defer func() {
+		clientConn.Close()
+		<-done
+	}()
+
+	batch := []byte(strings.Repeat(toRespArr(command...), pipeline))
+	batches := (b.N + pipeline - 1) / pipeline
+
+	// net.Pipe has no buffering, so the batches are written while the
+	// replies are read.
+	go func() {
+		for i := 0; i < batches; i++ {
+			if _, err := clientConn.Write(batch); err != nil {
+				return
+			}
+		}
+	}()
+
+	replies := bufio.NewReader(clientConn)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < batches*pipeline; i++ {
+		if err := skipReply(replies); err != nil {
+			b.Fatalf("reading reply: %v", err)
+		}
+	}
+}
+
+func skipReply(reader *bufio.Reader) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line[0] == '$' {
+		var length int
+		if _, err := fmt.Sscanf(line, "$%d\r\n", &length); err != nil {
+			return err
+		}
+		if length >= 0 {
+			_, err = reader.Discard(length + 2)
+		}
+	}
+	if line[0] == '-' {
+		return fmt.Errorf("%s", strings.TrimSpace(line))
+	}
+	return err
+}
+
+func BenchmarkHandleClient(b *testing.B) {
+	for _, command := range [][]string{{"PING"}, {"SET", "benchmark:key", "value"}, {"GET", "benchmark:key"}} {
+		for _, pipeline := range []int{1, 16, 128} {
+			for _, flushing := range []bool{true, false} {
+				name := fmt.Sprintf("%s/pipeline=%d/flushingReader=%v", command[0], pipeline, flushing)
+				b.Run(name, func(b *testing.B) {
+					benchmarkHandleClient(b, command, pipeline, flushing)
+				})
+			}
+		}
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const nullRespStr = "$-1\r\n"
+const requestTimeout = 500 * time.Millisecond
 
 func toRespStr(raw string) string {
 	length := len(raw)
@@ -27,7 +31,7 @@ func toRespArr(strs ...string) string {
 }
 
 func generateReplId() string {
-	bytes := make([]byte, 40)
+	bytes := make([]byte, 20)
 	rand.Read(bytes)
 
 	return hex.EncodeToString(bytes)
@@ -37,13 +41,20 @@ func addToInfoResponse(key string, value string, response *string) {
 	*response += "\r\n" + key + ":" + value
 }
 
+// Reads one line without its terminator. Masters send bare newlines to keep
+// the link alive while they prepare a snapshot, so empty lines are skipped.
 func readResp(reader *bufio.Reader) (string, error) {
-	message, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
-	}
+	for {
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
 
-	return message[:len(message)-2], nil
+		message = strings.TrimSuffix(strings.TrimSuffix(message, "\n"), "\r")
+		if message != "" {
+			return message, nil
+		}
+	}
 }
 
 func findMostRecentEntryByTimestamp(stream Stream, search int64) (StreamEntry, bool) {
@@ -74,13 +85,13 @@ func getEntriesInRange(stream Stream, startId string, endId string) ([]StreamEnt
 	if len(startIdParts) == 2 && startId != "-" {
 		startSeqNum, err = strconv.Atoi(startIdParts[1])
 		if err != nil {
-			return entries, err
+			return entries, invalidStreamIdErr
 		}
 	}
 	if len(endIdParts) == 2 && endId != "+" {
 		endSeqNum, err = strconv.Atoi(endIdParts[1])
 		if err != nil {
-			return entries, err
+			return entries, invalidStreamIdErr
 		}
 	}
 
@@ -88,14 +99,14 @@ func getEntriesInRange(stream Stream, startId string, endId string) ([]StreamEnt
 	if startId != "-" {
 		startTimestamp, err = strconv.ParseInt(startIdParts[0], 10, 64)
 		if err != nil {
-			return entries, err
+			return entries, invalidStreamIdErr
 		}
 	}
 	endTimestamp := int64(math.MaxInt64)
 	if endId != "+" {
 		endTimestamp, err = strconv.ParseInt(endIdParts[0], 10, 64)
 		if err != nil {
-			return entries, err
+			return entries, invalidStreamIdErr
 		}
 	}
 
@@ -133,40 +144,66 @@ func findMostRecentEntryId(stream *Stream) (int64, int, bool) {
 	return mostRecentTimestamp, mostRecentSeqNum, true
 }
 
-func parseRespCommand(reader *bufio.Reader) (rawCommand string, commandName string, args []string, err error) {
-	numArgsLeft := 0
-	args = []string{}
+// Sends a command to another instance over a fresh connection and returns
+// the reply flattened into strings (arrays are expected to be flat).
+func sendRequest(address string, args ...string) ([]string, error) {
+	conn, err := net.DialTimeout("tcp", address, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
 
-	var part string
-	for {
-		part, err = readResp(reader)
-		if err != nil {
-			return
-		}
+	if _, err := conn.Write([]byte(toRespArr(args...))); err != nil {
+		return nil, err
+	}
 
-		rawCommand += part + "\r\n"
-		if numArgsLeft == 0 && (part[0] != '*' || len(part) == 1) {
-			continue
-		}
+	reader := bufio.NewReader(conn)
+	return readRequestReply(reader)
+}
 
-		if numArgsLeft == 0 {
-			numArgsLeft, _ = strconv.Atoi(part[1:])
-			continue
-		}
+func readRequestReply(reader *bufio.Reader) ([]string, error) {
+	line, err := readResp(reader)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
 
-		if part[0] == '$' && len(part) > 1 {
-			continue
+	switch line[0] {
+	case '+', ':':
+		return []string{line[1:]}, nil
+	case '-':
+		return nil, fmt.Errorf("%s", line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
 		}
-
-		if len(commandName) == 0 {
-			commandName = strings.ToLower(part)
-		} else {
-			args = append(args, part)
+		if length < 0 {
+			return []string{""}, nil
 		}
-		numArgsLeft--
-
-		if numArgsLeft == 0 {
-			return
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return []string{string(data[:length])}, nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q", line)
 		}
+		values := []string{}
+		for i := 0; i < count; i++ {
+			value, err := readRequestReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value...)
+		}
+		return values, nil
 	}
+
+	return nil, fmt.Errorf("unexpected reply %q", line)
 }